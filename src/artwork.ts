@@ -0,0 +1,124 @@
+import { getNumberVar } from './config';
+import { errorResponse } from './response';
+import { fetchWithTimeout, upstreamErrorResponse, withFetchSlot } from './upstream';
+import { isAllowedUpstream, parseUrlParam } from './url';
+
+const DEFAULT_ARTWORK_MAX_DIMENSION = 1200;
+const ARTWORK_CACHE_CONTROL = 'public, max-age=2592000, immutable';
+const UNRESIZED_ARTWORK_CACHE_CONTROL = 'public, max-age=300';
+
+/**
+ * Parses a `w`/`h` param.
+ *
+ * @param value the raw param.
+ * @param max the largest allowed dimension.
+ * @returns the dimension, undefined when absent, or NaN when invalid.
+ */
+function parseDimension(value: string | null, max: number): number | undefined {
+  if (value === null) {
+    return undefined;
+  }
+
+  const dimension = Number(value);
+
+  return /^\d+$/.test(value) && dimension >= 1 && dimension <= max ? dimension : NaN;
+}
+
+/**
+ * Whether an artwork response is what was asked for. Image Resizing reports
+ * its work in `cf-resized` and errors there as `err=...`; where it isn't
+ * available, e.g. on workers.dev, `cf.image` is ignored and the original comes
+ * back instead.
+ *
+ * @param response the upstream response.
+ * @param resize whether a `w` or `h` was requested.
+ * @returns true when no resize was requested or the image was resized.
+ */
+function isAsRequested(response: Response, resize: boolean): boolean {
+  const resized = response.headers.get('cf-resized');
+
+  return !resize || (resized !== null && !/^err=/.test(resized));
+}
+
+/**
+ * Artwork proxy.
+ *
+ * Takes an mzstatic.com image `url`, which may be double-encoded, plus
+ * optional `w` and `h`, and resizes it with Cloudflare Image Resizing. A
+ * malformed `url` is rejected as `invalid_url` and any other host as
+ * `disallowed_url`. The
+ * image is scaled down to fit within the box while keeping its aspect ratio,
+ * and comes back in the source format.
+ * Dimensions are capped at `ARTWORK_MAX_DIMENSION`.
+ *
+ * Artwork is cached for 30 days as immutable, except when a resize was asked
+ * for but didn't happen, which only gets 5 minutes so the original isn't
+ * pinned under the resized URL.
+ *
+ * The fetch takes one of the `MAX_CONCURRENT_FETCHES` slots until the upstream
+ * answers, and fails the same way as the JSON proxy, e.g. with a `504` on
+ * timeout. `FETCH_TIMEOUT_MS` only covers the wait for the upstream's headers:
+ * the image then streams straight to the client with no deadline, so a body
+ * that stalls part way through holds the connection until the client or the
+ * upstream gives up.
+ *
+ * @param request the incoming request.
+ * @returns the response to send to the client.
+ */
+export async function handleArtwork(request: Request): Promise<Response> {
+  const { searchParams } = new URL(request.url);
+  const source = searchParams.get('url');
+  const max = getNumberVar('ARTWORK_MAX_DIMENSION', DEFAULT_ARTWORK_MAX_DIMENSION);
+  const width = parseDimension(searchParams.get('w'), max);
+  const height = parseDimension(searchParams.get('h'), max);
+
+  if (!source) {
+    return errorResponse(400, 'missing_url', 'Missing url parameter');
+  }
+
+  const url = parseUrlParam(source);
+
+  if (!url) {
+    return errorResponse(400, 'invalid_url', 'url must be an absolute http(s) URL');
+  }
+
+  if (!isAllowedUpstream(url) || !url.hostname.endsWith('.mzstatic.com')) {
+    return errorResponse(400, 'disallowed_url', 'url must be an mzstatic.com image URL');
+  }
+
+  if (Number.isNaN(width) || Number.isNaN(height)) {
+    return errorResponse(400, 'invalid_dimensions', `w and h must be integers between 1 and ${max}`);
+  }
+
+  const resize = width !== undefined || height !== undefined;
+  const init: RequestInit = { headers: { Accept: 'image/*' } };
+
+  // Plain fetches skip Image Resizing, which is billed per image.
+  if (resize) {
+    init.cf = { image: { width, height, fit: 'scale-down' } };
+  }
+
+  try {
+    return await withFetchSlot(() => fetchWithTimeout(url.toString(), async (response) => {
+      const headers = new Headers({ 'X-Upstream-Status': String(response.status) });
+      const contentType = response.headers.get('content-type');
+
+      if (contentType) {
+        headers.set('Content-Type', contentType);
+      }
+
+      if (response.ok) {
+        headers.set(
+          'Cache-Control',
+          isAsRequested(response, resize)
+            ? ARTWORK_CACHE_CONTROL
+            : UNRESIZED_ARTWORK_CACHE_CONTROL,
+        );
+      }
+
+      return new Response(response.body, { status: response.status, headers });
+    }, init));
+  } catch (err) {
+    return upstreamErrorResponse(err);
+  }
+}
@@ -0,0 +1,52 @@
+import { getVar } from './config';
+import { errorResponse } from './response';
+
+/**
+ * Compares two strings in time that depends only on their lengths, so a
+ * token can't be guessed one character at a time.
+ *
+ * @param a the first string.
+ * @param b the second string.
+ * @returns true when they are equal.
+ */
+function timingSafeEqual(a: string, b: string): boolean {
+  let diff = a.length ^ b.length;
+
+  for (let i = 0; i < Math.max(a.length, b.length); i++) {
+    diff |= (a.charCodeAt(i) || 0) ^ (b.charCodeAt(i) || 0);
+  }
+
+  return diff === 0;
+}
+
+/**
+ * Guards an operator endpoint with the shared secret in the `name` variable,
+ * sent as a `token` query param or an `Authorization: Bearer` header.
+ *
+ * The endpoint doesn't exist (`404`) while the variable is unset, and a
+ * missing or wrong token gets a `401`.
+ *
+ * @param request the incoming request.
+ * @param name the variable holding the token.
+ * @returns an error response, or undefined when the request may proceed.
+ */
+export function requireToken(request: Request, name: string): Response | undefined {
+  const expected = getVar(name);
+
+  if (!expected) {
+    return errorResponse(404, 'not_found', 'Not found');
+  }
+
+  const authorization = request.headers.get('authorization') || '';
+  const supplied = new URL(request.url).searchParams.get('token')
+    || (/^Bearer /i.test(authorization) ? authorization.slice(7).trim() : '');
+
+  if (!timingSafeEqual(supplied, expected)) {
+    const response = errorResponse(401, 'unauthorized', 'Missing or invalid token');
+    response.headers.set('WWW-Authenticate', 'Bearer');
+
+    return response;
+  }
+
+  return undefined;
+}
@@ -0,0 +1,228 @@
+import { requireToken } from './auth';
+import { getNumberVar } from './config';
+import { clampLimit, lookupUrl, primaryHost, secondaryHost } from './itunes';
+import { errorResponse, ErrorCode, headers } from './response';
+import { isAllowedUpstream, parseUrlParam } from './url';
+
+const DEFAULT_BATCH_MAX_ITEMS = 25;
+const DEFAULT_BATCH_CONCURRENCY = 5;
+const DEFAULT_WARMUP_MAX_ITEMS = 200;
+
+/**
+ * The iTunes endpoints a URL item may call.
+ */
+const ITEM_PATHS = ['/search', '/lookup'];
+
+type ItemResult =
+  | { item: unknown; status: number; body: unknown }
+  | { item: unknown; error: { code: ErrorCode; message: string } };
+
+/**
+ * Resolves a batch item to an upstream URL. URL items have to be iTunes
+ * `/search` or `/lookup` calls on the primary or secondary upstream, and are
+ * parsed like the artwork `url` param. A `limit` param on a URL item is
+ * clamped to the range iTunes accepts.
+ *
+ * @param item an iTunes ID (number or numeric string) or an iTunes URL.
+ * @returns the upstream URL and whether its limit was clamped, or an error
+ * for the item.
+ */
+function itemUrl(item: unknown): { url: string; clamped: boolean } | ItemResult {
+  if (typeof item === 'number' || (typeof item === 'string' && /^\d+$/.test(item))) {
+    return Number.isSafeInteger(Number(item)) && Number(item) > 0
+      ? { url: lookupUrl({ id: String(item) }), clamped: false }
+      : { item, error: { code: 'invalid_id', message: 'id must be a positive integer' } };
+  }
+
+  const url = typeof item === 'string' ? parseUrlParam(item) : undefined;
+
+  if (
+    url
+    && isAllowedUpstream(url)
+    && [primaryHost(), secondaryHost()].includes(url.hostname)
+    && ITEM_PATHS.includes(url.pathname)
+  ) {
+    const limitParam = url.searchParams.get('limit');
+    const limit = limitParam === null ? undefined : clampLimit(limitParam);
+
+    if (limitParam !== null && !limit) {
+      return { item, error: { code: 'invalid_limit', message: 'limit must be an integer' } };
+    }
+
+    if (limit) {
+      url.searchParams.set('limit', String(limit.limit));
+    }
+
+    return { url: url.toString(), clamped: !!limit && limit.clamped };
+  }
+
+  return {
+    item,
+    error: { code: 'invalid_url', message: 'item must be an iTunes ID or an iTunes search or lookup URL' },
+  };
+}
+
+/**
+ * Turns a proxied response into a batch result. Upstream responses carry
+ * `X-Upstream-Status`; anything else is one of our JSON errors.
+ *
+ * @param item the requested item.
+ * @param response the proxied response.
+ * @returns the item's result.
+ */
+async function itemResult(item: unknown, response: Response): Promise<ItemResult> {
+  const text = await response.text();
+  let body: unknown = text;
+
+  try {
+    body = JSON.parse(text);
+  } catch {
+    // Not JSON, keep the text.
+  }
+
+  if (!response.headers.has('X-Upstream-Status')) {
+    return { item, error: (body as { error: { code: ErrorCode; message: string } }).error };
+  }
+
+  return { item, status: response.status, body };
+}
+
+/**
+ * Runs `fn` over `items` with at most `limit` calls in flight.
+ *
+ * @param items the inputs.
+ * @param limit the maximum number of concurrent calls.
+ * @param fn the call to make for each item.
+ * @returns the results, in input order.
+ */
+async function mapConcurrent<T, R>(items: T[], limit: number, fn: (item: T) => Promise<R>): Promise<R[]> {
+  const results: R[] = new Array(items.length);
+  let next = 0;
+  const worker = async () => {
+    while (next < items.length) {
+      const index = next++;
+      results[index] = await fn(items[index]);
+    }
+  };
+
+  await Promise.all(Array.from({ length: Math.min(Math.max(limit, 1), items.length) }, worker));
+
+  return results;
+}
+
+/**
+ * Reads a JSON array of items from a request body.
+ *
+ * @param request the incoming request.
+ * @param maxItems the most items accepted.
+ * @returns the items, or an error response.
+ */
+async function readItems(request: Request, maxItems: number): Promise<unknown[] | Response> {
+  let items: unknown;
+
+  try {
+    items = await request.json();
+  } catch {
+    items = undefined;
+  }
+
+  if (!Array.isArray(items)) {
+    return errorResponse(400, 'invalid_body', 'Body must be a JSON array of iTunes IDs or URLs');
+  }
+
+  if (items.length > maxItems) {
+    return errorResponse(413, 'batch_too_large', `Batch may contain at most ${maxItems} items`);
+  }
+
+  return items;
+}
+
+/**
+ * Batch lookup endpoint.
+ *
+ * Accepts a JSON array of iTunes IDs or URLs, fetches up to
+ * `BATCH_CONCURRENCY` of them at a time through `fetchItem`, and returns a
+ * JSON array with a result per item. One item failing doesn't fail the batch.
+ * At most `BATCH_MAX_ITEMS` items are accepted. `X-Limit-Clamped: true` is
+ * set when any item's `limit` was clamped.
+ *
+ * @param request the incoming request.
+ * @param fetchItem fetches an upstream URL through the proxy.
+ * @returns the response to send to the client.
+ */
+export async function handleBatch(request: Request, fetchItem: (url: string) => Promise<Response>): Promise<Response> {
+  const items = await readItems(request, getNumberVar('BATCH_MAX_ITEMS', DEFAULT_BATCH_MAX_ITEMS));
+
+  if (items instanceof Response) {
+    return items;
+  }
+
+  let clamped = false;
+  const results = await mapConcurrent(
+    items,
+    getNumberVar('BATCH_CONCURRENCY', DEFAULT_BATCH_CONCURRENCY),
+    async (item) => {
+      const resolved = itemUrl(item);
+
+      if (!('url' in resolved)) {
+        return resolved;
+      }
+
+      clamped = clamped || resolved.clamped;
+
+      return itemResult(item, await fetchItem(resolved.url));
+    },
+  );
+  const response = new Response(JSON.stringify(results), { headers });
+
+  if (clamped) {
+    response.headers.set('X-Limit-Clamped', 'true');
+  }
+
+  return response;
+}
+
+/**
+ * Cache warmup endpoint, guarded by `ADMIN_TOKEN`.
+ *
+ * Accepts the same JSON array as `handleBatch`, up to `WARMUP_MAX_ITEMS`
+ * items, and loads them into the cache through `warmItem`. Loads run
+ * `BATCH_CONCURRENCY` at a time and are still bounded by
+ * `MAX_CONCURRENT_FETCHES`. Only counts are returned, not the bodies; an item
+ * succeeds once a fresh successful response for it is cached.
+ *
+ * @param request the incoming request.
+ * @param warmItem loads an upstream URL into the cache, resolving to whether
+ * it succeeded.
+ * @returns a summary of the items that succeeded and failed.
+ */
+export async function handleWarmup(request: Request, warmItem: (url: string) => Promise<boolean>): Promise<Response> {
+  const denied = requireToken(request, 'ADMIN_TOKEN');
+
+  if (denied) {
+    return denied;
+  }
+
+  const items = await readItems(request, getNumberVar('WARMUP_MAX_ITEMS', DEFAULT_WARMUP_MAX_ITEMS));
+
+  if (items instanceof Response) {
+    return items;
+  }
+
+  const outcomes = await mapConcurrent(
+    items,
+    getNumberVar('BATCH_CONCURRENCY', DEFAULT_BATCH_CONCURRENCY),
+    async (item) => {
+      const resolved = itemUrl(item);
+
+      return 'url' in resolved && warmItem(resolved.url);
+    },
+  );
+  const succeeded = outcomes.filter(Boolean).length;
+
+  return new Response(JSON.stringify({
+    total: items.length,
+    succeeded,
+    failed: items.length - succeeded,
+  }), { headers: { ...headers, 'cache-control': 'no-store' } });
+}
@@ -0,0 +1,145 @@
+import { getNumberVar } from './config';
+import { log } from './logger';
+
+const DEFAULT_BREAKER_WINDOW_SECONDS = 60;
+const DEFAULT_BREAKER_MIN_REQUESTS = 10;
+const DEFAULT_BREAKER_FAILURE_RATIO = 0.5;
+const DEFAULT_BREAKER_COOLDOWN_SECONDS = 30;
+
+type State = 'closed' | 'open' | 'half-open';
+
+interface Outcome {
+  time: number;
+  failed: boolean;
+}
+
+/**
+ * Thrown instead of calling the upstream while the circuit is open.
+ */
+export class CircuitOpenError extends Error {
+  /**
+   * @param retryAfter seconds until a trial request will be let through.
+   */
+  constructor(readonly retryAfter: number) {
+    super('Upstream circuit is open');
+  }
+}
+
+/**
+ * Circuit breaker around upstream calls.
+ *
+ * While closed, outcomes from the last `BREAKER_WINDOW_SECONDS` are tracked.
+ * Once at least `BREAKER_MIN_REQUESTS` are recorded and the share of failures
+ * reaches `BREAKER_FAILURE_RATIO`, the circuit opens and calls fail fast for
+ * `BREAKER_COOLDOWN_SECONDS`. After that a single trial call is let through
+ * (half-open): success closes the circuit, failure opens it again.
+ *
+ * State is kept per isolate.
+ */
+export class CircuitBreaker {
+  private state: State = 'closed';
+  private outcomes: Outcome[] = [];
+  private openedAt = 0;
+  private trialInFlight = false;
+
+  /**
+   * Runs a call through the breaker.
+   *
+   * @param call the upstream call.
+   * @param isFailure classifies a result as a failure, e.g. a `5xx` status.
+   * @returns the call's result.
+   * @throws CircuitOpenError when the circuit is open.
+   */
+  async run<T>(call: () => Promise<T>, isFailure: (result: T) => boolean): Promise<T> {
+    this.acquire();
+
+    try {
+      const result = await call();
+      this.record(isFailure(result));
+
+      return result;
+    } catch (err) {
+      this.record(true);
+      throw err;
+    }
+  }
+
+  /**
+   * Closes the circuit and forgets all outcomes.
+   */
+  reset(): void {
+    this.state = 'closed';
+    this.outcomes = [];
+    this.openedAt = 0;
+    this.trialInFlight = false;
+  }
+
+  private acquire(): void {
+    const cooldown = getNumberVar('BREAKER_COOLDOWN_SECONDS', DEFAULT_BREAKER_COOLDOWN_SECONDS) * 1000;
+
+    if (this.state === 'open') {
+      const remaining = this.openedAt + cooldown - Date.now();
+
+      if (remaining > 0) {
+        throw new CircuitOpenError(Math.ceil(remaining / 1000));
+      }
+
+      this.transition('half-open');
+    }
+
+    if (this.state === 'half-open') {
+      if (this.trialInFlight) {
+        throw new CircuitOpenError(1);
+      }
+
+      this.trialInFlight = true;
+    }
+  }
+
+  private record(failed: boolean): void {
+    const now = Date.now();
+
+    if (this.state === 'half-open') {
+      this.trialInFlight = false;
+      this.outcomes = [];
+
+      if (failed) {
+        this.open(now);
+      } else {
+        this.transition('closed');
+      }
+
+      return;
+    }
+
+    if (this.state === 'open') {
+      return;
+    }
+
+    const window = getNumberVar('BREAKER_WINDOW_SECONDS', DEFAULT_BREAKER_WINDOW_SECONDS) * 1000;
+    const minRequests = getNumberVar('BREAKER_MIN_REQUESTS', DEFAULT_BREAKER_MIN_REQUESTS);
+    const ratio = getNumberVar('BREAKER_FAILURE_RATIO', DEFAULT_BREAKER_FAILURE_RATIO);
+
+    this.outcomes.push({ time: now, failed });
+    this.outcomes = this.outcomes.filter((outcome) => now - outcome.time < window);
+
+    const failures = this.outcomes.filter((outcome) => outcome.failed).length;
+
+    if (this.outcomes.length >= minRequests && failures / this.outcomes.length >= ratio) {
+      this.outcomes = [];
+      this.open(now);
+    }
+  }
+
+  private open(now: number): void {
+    this.openedAt = now;
+    this.transition('open');
+  }
+
+  private transition(to: State): void {
+    log('warn', 'circuit breaker state change', { from: this.state, to });
+    this.state = to;
+  }
+}
+
+export const circuitBreaker = new CircuitBreaker();
@@ -0,0 +1,95 @@
+import { getNumberVar } from './config';
+import { BufferedResponse } from './upstream';
+
+const DEFAULT_CACHE_TTL_SECONDS = 300;
+const DEFAULT_NEGATIVE_CACHE_TTL_SECONDS = 60;
+const DEFAULT_CACHE_MAX_ENTRIES = 1000;
+
+interface CacheEntry {
+  response: BufferedResponse;
+  expires: number;
+  staleUntil: number;
+}
+
+/**
+ * A cache hit. Stale hits are past their TTL but within the
+ * stale-while-revalidate window.
+ */
+export interface CacheHit {
+  response: BufferedResponse;
+  stale: boolean;
+}
+
+/**
+ * In-memory LRU cache of upstream responses.
+ *
+ * Entries live in the isolate's memory, so each isolate keeps its own cache
+ * and it is lost whenever the isolate is recycled. The TTL and size are read
+ * from `CACHE_TTL_SECONDS` and `CACHE_MAX_ENTRIES`; `404` responses use the
+ * shorter `NEGATIVE_CACHE_TTL_SECONDS`. Entries are kept for a further
+ * `STALE_WHILE_REVALIDATE_SECONDS` (default 0) after expiring, during which
+ * they are returned as stale.
+ */
+export class ResponseCache {
+  private entries = new Map<string, CacheEntry>();
+
+  /**
+   * Looks up a fresh or stale entry, marking it as most recently used.
+   *
+   * @param key the cache key.
+   * @returns the cache hit, or undefined on a miss.
+   */
+  get(key: string): CacheHit | undefined {
+    const entry = this.entries.get(key);
+    const now = Date.now();
+
+    if (!entry) {
+      return undefined;
+    }
+
+    this.entries.delete(key);
+
+    if (entry.staleUntil <= now) {
+      return undefined;
+    }
+
+    this.entries.set(key, entry);
+
+    return { response: entry.response, stale: entry.expires <= now };
+  }
+
+  /**
+   * Stores a response, evicting the least recently used entries when full.
+   *
+   * @param key the cache key.
+   * @param response the response to store.
+   */
+  set(key: string, response: BufferedResponse): void {
+    const ttl = response.status === 404
+      ? getNumberVar('NEGATIVE_CACHE_TTL_SECONDS', DEFAULT_NEGATIVE_CACHE_TTL_SECONDS)
+      : getNumberVar('CACHE_TTL_SECONDS', DEFAULT_CACHE_TTL_SECONDS);
+    const staleWhileRevalidate = getNumberVar('STALE_WHILE_REVALIDATE_SECONDS', 0);
+    const maxEntries = getNumberVar('CACHE_MAX_ENTRIES', DEFAULT_CACHE_MAX_ENTRIES);
+    const expires = Date.now() + ttl * 1000;
+
+    this.entries.delete(key);
+    this.entries.set(key, { response, expires, staleUntil: expires + staleWhileRevalidate * 1000 });
+
+    for (const oldest of this.entries.keys()) {
+      if (this.entries.size <= maxEntries) {
+        break;
+      }
+
+      this.entries.delete(oldest);
+    }
+  }
+
+  /**
+   * Removes every entry.
+   */
+  clear(): void {
+    this.entries.clear();
+  }
+}
+
+export const responseCache = new ResponseCache();
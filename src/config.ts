@@ -0,0 +1,30 @@
+/**
+ * Reads a worker environment variable.
+ *
+ * In the service-worker format, `[vars]` from wrangler.toml are bound as
+ * globals rather than passed in, so they are looked up on `globalThis`.
+ *
+ * @param name the variable name.
+ * @returns the value, or undefined when unset or empty.
+ */
+export function getVar(name: string): string | undefined {
+  const value = (globalThis as Record<string, unknown>)[name];
+
+  return typeof value === 'string' && value !== '' ? value : undefined;
+}
+
+/**
+ * Reads a numeric worker environment variable.
+ *
+ * @param name the variable name.
+ * @param fallback value used when the variable is unset or not a non-negative number.
+ * @returns the parsed value.
+ */
+export function getNumberVar(name: string, fallback: number): number {
+  const raw = getVar(name);
+  const value = Number(raw);
+
+  return raw !== undefined && Number.isFinite(value) && value >= 0
+    ? value
+    : fallback;
+}
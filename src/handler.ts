@@ -0,0 +1,563 @@
+import { handleArtwork } from './artwork';
+import { handleBatch, handleWarmup } from './batch';
+import { responseCache } from './cache';
+import { getNumberVar, getVar } from './config';
+import { handleHealthz, handleReadyz } from './health';
+import { clampLimit, lookupUrl, SearchOptions, searchUrl, validStorefront } from './itunes';
+import { log } from './logger';
+import { RequestContext } from './middleware';
+import { maxSearchResults, searchAll } from './pagination';
+import { errorResponse, headers } from './response';
+import { handleStats } from './stats';
+import { endSpan, startSpan } from './tracing';
+import { stripFields } from './transform';
+import { BufferedResponse, sharedFetch, upstreamErrorResponse } from './upstream';
+import { normalizeURL } from './url';
+import { handleVersion } from './version';
+
+const DEFAULT_MAX_AGE = 300;
+
+/**
+ * Whether an upstream response may be stored in the cache. Besides
+ * successful responses, `404`s are cached as negative results; `5xx`s never
+ * are.
+ *
+ * @param response the upstream response.
+ * @returns true for 2xx and 404 responses unless the upstream sent
+ * `Cache-Control: no-store`.
+ */
+function isCacheable(response: BufferedResponse): boolean {
+  const cacheControl = new Headers(response.headers).get('cache-control') || '';
+  const status = response.status;
+
+  return ((status >= 200 && status < 300) || status === 404) && !/no-store/i.test(cacheControl);
+}
+
+/**
+ * Conditional request headers forwarded to the upstream.
+ */
+const CONDITIONAL_HEADERS = ['if-none-match', 'if-modified-since'];
+
+/**
+ * Whether a cached response satisfies the client's conditional headers, so a
+ * `304 Not Modified` can be returned without contacting the upstream.
+ *
+ * @param clientHeaders the incoming request headers.
+ * @param cached the cached response.
+ * @returns true when the client's copy is still current.
+ */
+function isNotModified(clientHeaders: Headers, cached: BufferedResponse): boolean {
+  const cachedHeaders = new Headers(cached.headers);
+  const ifNoneMatch = clientHeaders.get('if-none-match');
+  const etag = cachedHeaders.get('etag');
+  const ifModifiedSince = Date.parse(clientHeaders.get('if-modified-since') || '');
+  const lastModified = Date.parse(cachedHeaders.get('last-modified') || '');
+
+  if (ifNoneMatch) {
+    const weak = (tag: string) => tag.trim().replace(/^W\//, '');
+
+    return ifNoneMatch.trim() === '*'
+      || (!!etag && ifNoneMatch.split(',').some((tag) => weak(tag) === weak(etag)));
+  }
+
+  return !Number.isNaN(ifModifiedSince) && !Number.isNaN(lastModified) && lastModified <= ifModifiedSince;
+}
+
+/**
+ * Builds a client response from a buffered upstream response.
+ *
+ * The upstream status is echoed in `X-Upstream-Status`, so clients can tell
+ * an iTunes error apart from one raised by the proxy itself.
+ *
+ * With `EMIT_CACHE_CONTROL=true`, successful responses get
+ * `Cache-Control: public, max-age=DEFAULT_MAX_AGE` (default 300) so the edge
+ * can cache them, unless the upstream sent `no-store` or `private`.
+ *
+ * @param upstream the buffered response.
+ * @param cacheStatus value for the `X-Cache` header.
+ * @param method the client's request method; `HEAD` responses have no body.
+ * @param status overrides the upstream status, e.g. `304` for a cache hit the
+ * client already has.
+ * @returns the client response.
+ */
+function toResponse(
+  upstream: BufferedResponse,
+  cacheStatus: string,
+  method: string,
+  status = upstream.status,
+): Response {
+  const responseHeaders = new Headers(upstream.headers);
+  responseHeaders.set('X-Cache', cacheStatus);
+  responseHeaders.set('X-Upstream-Status', String(upstream.status));
+
+  if (
+    getVar('EMIT_CACHE_CONTROL') === 'true'
+    && ((status >= 200 && status < 300) || status === 304)
+    && !/no-store|private/i.test(responseHeaders.get('cache-control') || '')
+  ) {
+    responseHeaders.set('Cache-Control', `public, max-age=${getNumberVar('DEFAULT_MAX_AGE', DEFAULT_MAX_AGE)}`);
+  }
+
+  const hasBody = method !== 'HEAD' && status !== 204 && status !== 304;
+
+  return new Response(hasBody ? upstream.body : null, {
+    status,
+    headers: responseHeaders,
+  });
+}
+
+/**
+ * Fetches an upstream URL and stores the response in the cache when it is
+ * cacheable.
+ *
+ * @param key the cache key.
+ * @param url the upstream URL.
+ * @param upstreamHeaders headers to send upstream.
+ * @returns the upstream response.
+ */
+async function refresh(key: string, url: string, upstreamHeaders: Record<string, string>): Promise<BufferedResponse> {
+  const response = stripFields(await sharedFetch(key, url, { method: 'GET', headers: upstreamHeaders }));
+
+  if (isCacheable(response)) {
+    responseCache.set(key, response);
+  }
+
+  return response;
+}
+
+/**
+ * Refreshes a stale cache entry in the background. The refresh joins any
+ * in-flight fetch for the key, so at most one runs per key, and it is bounded
+ * by the fetch's own timeout rather than the client request.
+ *
+ * @param key the cache key.
+ * @param url the upstream URL.
+ * @param upstreamHeaders headers to send upstream.
+ * @param context provides `waitUntil` to outlive the response.
+ */
+function revalidate(
+  key: string,
+  url: string,
+  upstreamHeaders: Record<string, string>,
+  context: RequestContext,
+): void {
+  const refreshed = refresh(key, url, upstreamHeaders).catch((err) => {
+    log('warn', 'cache revalidation failed', { requestId: context.requestId, upstreamUrl: key, error: String(err) });
+  });
+
+  if (context.waitUntil) {
+    context.waitUntil(refreshed);
+  }
+}
+
+/**
+ * Loads an upstream URL into the cache for `/warmup`. A fresh successful
+ * entry is kept; otherwise the URL is fetched, and the fetch is awaited so
+ * the result reflects what is cached once the warmup responds.
+ *
+ * @param url the upstream URL.
+ * @param context state shared with the middleware.
+ * @returns true when a fresh successful response is in the cache.
+ */
+async function warmCache(url: string, context: RequestContext): Promise<boolean> {
+  const key = normalizeURL(url);
+  const hit = responseCache.get(key);
+  const ok = (response: BufferedResponse) => response.status >= 200 && response.status < 300;
+
+  if (hit && !hit.stale && ok(hit.response)) {
+    return true;
+  }
+
+  try {
+    const response = await refresh(key, url, {});
+
+    return ok(response) && isCacheable(response);
+  } catch (err) {
+    log('warn', 'cache warmup failed', { requestId: context.requestId, upstreamUrl: key, error: String(err) });
+
+    return false;
+  }
+}
+
+/**
+ * Fetches an upstream URL and forwards the response, serving successful and
+ * `404` responses from the cache when possible. Concurrent requests for the
+ * same URL share one upstream fetch. Both are keyed by the normalized URL.
+ *
+ * Within `STALE_WHILE_REVALIDATE_SECONDS` of expiring, a cached response is
+ * still served, marked `X-Cache: STALE`, while it is refreshed in the
+ * background.
+ *
+ * `HEAD` requests are answered from a cached `GET` when there is one, and
+ * otherwise forwarded upstream as `HEAD`. Only `GET` responses are cached.
+ *
+ * With `FORWARD_ACCEPT_LANGUAGE=true` the client's `Accept-Language` is sent
+ * upstream and becomes part of the cache key.
+ *
+ * `If-None-Match` and `If-Modified-Since` are answered from the cache when
+ * possible and otherwise forwarded, so an upstream `304 Not Modified` reaches
+ * the client with no body. Conditional fetches aren't shared with
+ * unconditional ones.
+ *
+ * A `504 Gateway Timeout` is returned when the upstream exceeds
+ * `FETCH_TIMEOUT_MS`, and a `503 Service Unavailable` while the circuit
+ * breaker is open or no fetch slot is free. Any other upstream failure,
+ * including a body larger than `MAX_RESPONSE_BYTES` or a rejected redirect,
+ * is reported as a `502 Bad Gateway`.
+ *
+ * @param method `GET` or `HEAD`.
+ * @param url the upstream URL.
+ * @param clientHeaders the incoming request headers.
+ * @param context records the upstream URL and status.
+ * @returns the response to send to the client.
+ */
+async function proxyRequest(
+  method: string,
+  url: string,
+  clientHeaders: Headers,
+  context: RequestContext,
+): Promise<Response> {
+  const upstreamHeaders: Record<string, string> = {};
+  const acceptLanguage = clientHeaders.get('accept-language');
+  const normalized = normalizeURL(url);
+  let key = normalized;
+  context.upstreamUrl = normalized;
+
+  if (getVar('FORWARD_ACCEPT_LANGUAGE') === 'true' && acceptLanguage) {
+    upstreamHeaders['Accept-Language'] = acceptLanguage;
+    key += ` accept-language=${acceptLanguage}`;
+  }
+
+  const hit = responseCache.get(key);
+
+  if (hit && hit.stale) {
+    revalidate(key, url, upstreamHeaders, context);
+
+    return toResponse(hit.response, 'STALE', method);
+  }
+
+  if (hit) {
+    const cached = hit.response;
+
+    if (cached.status === 404) {
+      return toResponse(cached, 'HIT-NEGATIVE', method);
+    }
+
+    return toResponse(cached, 'HIT', method, isNotModified(clientHeaders, cached) ? 304 : cached.status);
+  }
+
+  let fetchKey = key;
+
+  CONDITIONAL_HEADERS.forEach((name) => {
+    const value = clientHeaders.get(name);
+
+    if (value) {
+      upstreamHeaders[name] = value;
+      fetchKey += ` ${name}=${value}`;
+    }
+  });
+
+  const span = startSpan(context, method, {
+    'http.request.method': method,
+    'server.address': new URL(url).hostname,
+    'url.full': normalized,
+  });
+
+  try {
+    const response = stripFields(await sharedFetch(fetchKey, url, { method, headers: upstreamHeaders }));
+    context.upstreamStatus = response.status;
+    endSpan(span, {
+      'http.response.status_code': response.status,
+      'http.response.body.size': response.body.byteLength,
+    }, response.status >= 500);
+
+    if (method === 'GET' && isCacheable(response)) {
+      responseCache.set(key, response);
+    }
+
+    return toResponse(response, 'MISS', method);
+  } catch (err) {
+    endSpan(span, { 'error.type': err instanceof Error ? err.constructor.name : 'Error' }, true);
+
+    return upstreamErrorResponse(err);
+  }
+}
+
+/**
+ * The client headers passed on when the proxy makes several upstream calls for
+ * one request, as `/batch` and `all=true` do. Of the headers `proxyRequest`
+ * reads, only `Accept-Language` applies; conditional headers describe the
+ * client's copy of the combined response, not of each part.
+ *
+ * @param clientHeaders the incoming request headers.
+ * @returns the headers to proxy each call with.
+ */
+function subrequestHeaders(clientHeaders: Headers): Headers {
+  const forwarded = new Headers();
+  const acceptLanguage = clientHeaders.get('accept-language');
+
+  if (acceptLanguage) {
+    forwarded.set('Accept-Language', acceptLanguage);
+  }
+
+  return forwarded;
+}
+
+/**
+ * Resolves the storefront for a request: the `country` param, or
+ * `DEFAULT_STOREFRONT` when absent. An unknown default is ignored so a bad
+ * setting can't break every request.
+ *
+ * @param searchParams the request's query params.
+ * @returns the lowercased country code, undefined for iTunes' default, or an
+ * error response for an unknown code.
+ */
+function resolveStorefront(searchParams: URLSearchParams): string | undefined | Response {
+  const country = searchParams.get('country');
+
+  if (country === null || country === '') {
+    const fallback = getVar('DEFAULT_STOREFRONT');
+
+    return fallback && validStorefront(fallback) ? fallback.toLowerCase() : undefined;
+  }
+
+  if (!validStorefront(country)) {
+    return errorResponse(400, 'invalid_country', 'country must be an ISO 3166-1 alpha-2 code of an iTunes storefront');
+  }
+
+  return country.toLowerCase();
+}
+
+/**
+ * iTunes search API.
+ *
+ * A `limit` outside 1 to 200 is clamped into range and flagged with
+ * `X-Limit-Clamped: true`.
+ *
+ * With `all=true` the search is paged through and merged, up to `max`
+ * results; `max` defaults to and is clamped at the `SEARCH_MAX_PAGES` cap,
+ * and `limit` is rejected since paging sets it.
+ *
+ * @param request the incoming request.
+ * @param termParam the param holding the search term.
+ * @param context state shared with the middleware.
+ * @returns the response to send to the client.
+ */
+async function handleSearch(request: Request, termParam: string, context: RequestContext): Promise<Response> {
+  const { searchParams } = new URL(request.url);
+  const term = searchParams.get(termParam);
+  const limitParam = searchParams.get('limit');
+  const limit = limitParam === null ? undefined : clampLimit(limitParam);
+  const country = resolveStorefront(searchParams);
+
+  if (!term) {
+    return errorResponse(400, 'missing_query', `Missing ${termParam} parameter`);
+  }
+
+  if (limitParam !== null && !limit) {
+    return errorResponse(400, 'invalid_limit', 'limit must be an integer');
+  }
+
+  if (country instanceof Response) {
+    return country;
+  }
+
+  const options = {
+    term,
+    media: searchParams.get('media') || 'podcast',
+    entity: searchParams.get('entity') || undefined,
+    limit: limit && String(limit.limit),
+    country,
+  };
+
+  if (searchParams.get('all') === 'true') {
+    if (limitParam !== null) {
+      return errorResponse(400, 'invalid_limit', 'limit cannot be combined with all=true, use max instead');
+    }
+
+    return handleSearchAll(request, options, context);
+  }
+
+  const response = await proxyRequest(request.method, searchUrl(options), request.headers, context);
+
+  if (limit && limit.clamped) {
+    response.headers.set('X-Limit-Clamped', 'true');
+  }
+
+  return response;
+}
+
+/**
+ * Paged search for `all=true`. Pages are fetched with the client's
+ * `Accept-Language` and answered for both `GET` and `HEAD`.
+ *
+ * @param request the incoming request.
+ * @param options the search parameters.
+ * @param context state shared with the middleware.
+ * @returns the merged response.
+ */
+async function handleSearchAll(
+  request: Request,
+  options: SearchOptions,
+  context: RequestContext,
+): Promise<Response> {
+  const maxParam = new URL(request.url).searchParams.get('max');
+  const cap = maxSearchResults();
+
+  if (maxParam !== null && !(/^\d+$/.test(maxParam) && Number(maxParam) >= 1)) {
+    return errorResponse(400, 'invalid_limit', 'max must be a positive integer');
+  }
+
+  const max = maxParam === null ? cap : Math.min(Number(maxParam), cap);
+  const pageHeaders = subrequestHeaders(request.headers);
+  const merged = await searchAll(options, max, (url) => proxyRequest('GET', url, pageHeaders, context));
+  const response = new Response(request.method === 'HEAD' ? null : merged.body, merged);
+
+  if (maxParam !== null && Number(maxParam) > cap) {
+    response.headers.set('X-Limit-Clamped', 'true');
+  }
+
+  return response;
+}
+
+/**
+ * iTunes lookup API.
+ *
+ * @param request the incoming request.
+ * @param context state shared with the middleware.
+ * @returns the response to send to the client.
+ */
+async function handleLookup(request: Request, context: RequestContext): Promise<Response> {
+  const { searchParams } = new URL(request.url);
+  const id = searchParams.get('id');
+  const country = resolveStorefront(searchParams);
+
+  if (!id) {
+    return errorResponse(400, 'missing_id', 'Missing id parameter');
+  }
+
+  if (!/^\d+(,\d+)*$/.test(id)) {
+    return errorResponse(400, 'invalid_id', 'id must be one or more comma-separated numeric IDs');
+  }
+
+  if (country instanceof Response) {
+    return country;
+  }
+
+  const url = lookupUrl({
+    id,
+    entity: searchParams.get('entity') || undefined,
+    country,
+  });
+
+  return proxyRequest(request.method, url, request.headers, context);
+}
+
+/**
+ * Builds a `405 Method Not Allowed` response.
+ *
+ * @param request the incoming request.
+ * @param allow the methods the path accepts.
+ * @returns the error response.
+ */
+function methodNotAllowed(request: Request, allow: string): Response {
+  const response = errorResponse(405, 'method_not_allowed', `Method ${request.method} not allowed`);
+  response.headers.set('Allow', allow);
+
+  return response;
+}
+
+/**
+ * Public endpoints, listed in the body of a `404`.
+ */
+const ENDPOINTS = ['/', '/search', '/lookup', '/batch', '/artwork', '/healthz', '/readyz', '/version'];
+
+/**
+ * Builds a `404 Not Found` response listing the available endpoints.
+ *
+ * @param pathname the requested path.
+ * @returns the error response.
+ */
+function notFound(pathname: string): Response {
+  return new Response(JSON.stringify({
+    error: { code: 'not_found', message: `No endpoint at ${pathname}` },
+    endpoints: ENDPOINTS,
+  }), { status: 404, headers });
+}
+
+/**
+ * Podcast search API endpoint, plus health checks and `/version`.
+ *
+ * `/search` takes the search term as `term` and `/lookup` takes iTunes IDs;
+ * `/` keeps the original `q` search param. `/batch` takes a `POST` of
+ * several IDs or URLs at once, and `/artwork` resizes podcast artwork.
+ * `/debug/stats` reports per-URL request stats to operators, and `/warmup`
+ * lets them prime the cache. Any other path gets a `404` listing the
+ * endpoints.
+ *
+ * @param request the incoming request.
+ * @param context state shared with the middleware.
+ * @returns the response to send to the client.
+ */
+export async function handleRequest(request: Request, context: RequestContext = {}): Promise<Response> {
+  const { pathname } = new URL(request.url);
+
+  if (pathname === '/healthz') {
+    return handleHealthz();
+  }
+
+  if (pathname === '/readyz') {
+    return handleReadyz();
+  }
+
+  if (pathname === '/version') {
+    return handleVersion();
+  }
+
+  if (pathname === '/batch') {
+    if (request.method !== 'POST') {
+      return methodNotAllowed(request, 'POST');
+    }
+
+    const itemHeaders = subrequestHeaders(request.headers);
+    const { requestId, spans, waitUntil } = context;
+
+    // Each item gets its own context, so its upstream URL and status don't
+    // overwrite the batch's, but it shares the request ID, spans and waitUntil.
+    return handleBatch(request, (url) => proxyRequest('GET', url, itemHeaders, { requestId, spans, waitUntil }));
+  }
+
+  if (pathname === '/warmup') {
+    if (request.method !== 'POST') {
+      return methodNotAllowed(request, 'POST');
+    }
+
+    return handleWarmup(request, (url) => warmCache(url, context));
+  }
+
+  if (!ENDPOINTS.includes(pathname) && pathname !== '/debug/stats') {
+    return notFound(pathname);
+  }
+
+  if (request.method !== 'GET' && request.method !== 'HEAD') {
+    return methodNotAllowed(request, 'GET, HEAD');
+  }
+
+  if (pathname === '/debug/stats') {
+    return handleStats(request);
+  }
+
+  if (pathname === '/search') {
+    return handleSearch(request, 'term', context);
+  }
+
+  if (pathname === '/lookup') {
+    return handleLookup(request, context);
+  }
+
+  if (pathname === '/artwork') {
+    return handleArtwork(request);
+  }
+
+  return handleSearch(request, 'q', context);
+}
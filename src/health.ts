@@ -0,0 +1,40 @@
+import { getVar } from './config';
+import { fetchWithTimeout } from './upstream';
+
+const PROBE_URL = 'https://itunes.apple.com/search?media=podcast&term=podcast&limit=1';
+
+const textHeaders = {
+  'content-type': 'text/plain;charset=UTF-8',
+};
+
+/**
+ * Liveness check. Always succeeds while the worker can serve requests.
+ *
+ * @returns `200 OK` with body `ok`.
+ */
+export function handleHealthz(): Response {
+  return new Response('ok', { headers: textHeaders });
+}
+
+/**
+ * Readiness check.
+ *
+ * A worker is ready as soon as it can run, so this only fails when
+ * `READY_PROBE=true` and a small iTunes search does not succeed.
+ *
+ * @returns `200 OK` when ready, otherwise `503 Service Unavailable`.
+ */
+export async function handleReadyz(): Promise<Response> {
+  if (getVar('READY_PROBE') === 'true') {
+    const reachable = await fetchWithTimeout(PROBE_URL, async (response) => response.ok).catch(() => false);
+
+    if (!reachable) {
+      return new Response('iTunes unreachable', {
+        status: 503,
+        headers: textHeaders,
+      });
+    }
+  }
+
+  return new Response('ok', { headers: textHeaders });
+}
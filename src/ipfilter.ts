@@ -0,0 +1,133 @@
+import { log } from './logger';
+
+interface Range {
+  bits: number;
+  network: bigint;
+  prefix: number;
+}
+
+/**
+ * Parses an IPv4 or IPv6 address. IPv4-mapped IPv6 addresses
+ * (`::ffff:192.0.2.1`) are returned as IPv4, so they match IPv4 rules.
+ *
+ * @param text the address.
+ * @returns the address width and value, or undefined when malformed.
+ */
+function parseIp(text: string): { bits: number; value: bigint } | undefined {
+  const v4 = /^(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.(\d{1,3})$/.exec(text);
+
+  if (v4) {
+    const octets = v4.slice(1).map(Number);
+
+    return octets.every((octet) => octet <= 255)
+      ? { bits: 32, value: octets.reduce((value, octet) => (value << 8n) | BigInt(octet), 0n) }
+      : undefined;
+  }
+
+  const halves = text.toLowerCase().split('::');
+
+  if (!text.includes(':') || halves.length > 2) {
+    return undefined;
+  }
+
+  const groups = halves.map((half) => (half ? half.split(':') : []));
+  const last = groups[groups.length - 1];
+
+  if (last.length && last[last.length - 1].includes('.')) {
+    const embedded = parseIp(last.pop() as string);
+
+    if (!embedded || embedded.bits !== 32) {
+      return undefined;
+    }
+
+    last.push((embedded.value >> 16n).toString(16), (embedded.value & 0xffffn).toString(16));
+  }
+
+  const count = groups.reduce((total, half) => total + half.length, 0);
+
+  if (halves.length === 1 ? count !== 8 : count > 7) {
+    return undefined;
+  }
+
+  const all = halves.length === 1 ? groups[0] : [...groups[0], ...Array(8 - count).fill('0'), ...groups[1]];
+
+  if (!all.every((group) => /^[0-9a-f]{1,4}$/.test(group))) {
+    return undefined;
+  }
+
+  const value = all.reduce((total, group) => (total << 16n) | BigInt(parseInt(group, 16)), 0n);
+
+  return value >> 32n === 0xffffn
+    ? { bits: 32, value: value & 0xffffffffn }
+    : { bits: 128, value };
+}
+
+/**
+ * Parses an address or CIDR range such as `192.0.2.0/24` or `2001:db8::/32`.
+ *
+ * @param entry the list entry.
+ * @returns the range, or undefined when malformed.
+ */
+function parseRange(entry: string): Range | undefined {
+  const [address, prefixText, ...rest] = entry.split('/');
+  const ip = parseIp(address);
+
+  if (!ip || rest.length || (prefixText !== undefined && !/^\d{1,3}$/.test(prefixText))) {
+    return undefined;
+  }
+
+  const mapped = address.includes(':') && ip.bits === 32;
+  const prefix = prefixText === undefined ? ip.bits : Number(prefixText) - (mapped ? 96 : 0);
+
+  if (prefix < 0 || prefix > ip.bits) {
+    return undefined;
+  }
+
+  return { bits: ip.bits, network: ip.value >> BigInt(ip.bits - prefix), prefix };
+}
+
+const parsed = new Map<string, Range[]>();
+
+/**
+ * Parses a comma-separated list of addresses and CIDR ranges, remembering
+ * the result so the variable is only parsed once. Malformed entries are
+ * logged and skipped.
+ *
+ * @param list the raw list.
+ * @returns the ranges.
+ */
+function parseList(list: string): Range[] {
+  let ranges = parsed.get(list);
+
+  if (!ranges) {
+    ranges = [];
+
+    for (const entry of list.split(',').map((item) => item.trim()).filter(Boolean)) {
+      const range = parseRange(entry);
+
+      if (range) {
+        ranges.push(range);
+      } else {
+        log('warn', 'ignoring malformed IP list entry', { entry });
+      }
+    }
+
+    parsed.set(list, ranges);
+  }
+
+  return ranges;
+}
+
+/**
+ * Whether an address falls within any entry of a list.
+ *
+ * @param ip the client address.
+ * @param list a comma-separated list of addresses and CIDR ranges.
+ * @returns true when the address matches; false for malformed addresses.
+ */
+export function ipInList(ip: string, list: string): boolean {
+  const address = parseIp(ip.trim());
+
+  return !!address && parseList(list).some((range) => range.bits === address.bits
+    && address.value >> BigInt(range.bits - range.prefix) === range.network);
+}
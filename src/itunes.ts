@@ -0,0 +1,159 @@
+import { getVar } from './config';
+
+const DEFAULT_UPSTREAM_PRIMARY = 'itunes.apple.com';
+
+/**
+ * Largest `limit` the iTunes Search API accepts.
+ */
+export const MAX_LIMIT = 200;
+
+/**
+ * The host iTunes API URLs are built against, from `UPSTREAM_PRIMARY`.
+ *
+ * @returns the primary host.
+ */
+export function primaryHost(): string {
+  return (getVar('UPSTREAM_PRIMARY') || DEFAULT_UPSTREAM_PRIMARY).toLowerCase();
+}
+
+/**
+ * The host to fail over to when the primary is down, from
+ * `UPSTREAM_SECONDARY`.
+ *
+ * @returns the secondary host, or undefined when there is none.
+ */
+export function secondaryHost(): string | undefined {
+  const host = getVar('UPSTREAM_SECONDARY');
+
+  return host && host.toLowerCase();
+}
+
+/**
+ * A `limit` param clamped to the range iTunes accepts.
+ */
+export interface ClampedLimit {
+  limit: number;
+  clamped: boolean;
+}
+
+/**
+ * Parses a `limit` param, clamping it to 1 through `MAX_LIMIT`.
+ *
+ * @param value the raw param.
+ * @returns the limit and whether it had to be clamped, or undefined when the
+ * param isn't an integer.
+ */
+export function clampLimit(value: string): ClampedLimit | undefined {
+  if (!/^-?\d+$/.test(value)) {
+    return undefined;
+  }
+
+  const requested = Number(value);
+  const limit = Math.min(Math.max(requested, 1), MAX_LIMIT);
+
+  return { limit, clamped: limit !== requested };
+}
+
+/**
+ * ISO 3166-1 alpha-2 codes of the storefronts iTunes serves.
+ */
+const STOREFRONTS = new Set([
+  'ae', 'ag', 'ai', 'al', 'am', 'ao', 'ar', 'at', 'au', 'az', 'ba', 'bb', 'be',
+  'bf', 'bg', 'bh', 'bj', 'bm', 'bn', 'bo', 'br', 'bs', 'bt', 'bw', 'by', 'bz',
+  'ca', 'cd', 'cg', 'ch', 'ci', 'cl', 'cm', 'cn', 'co', 'cr', 'cv', 'cy', 'cz',
+  'de', 'dk', 'dm', 'do', 'dz', 'ec', 'ee', 'eg', 'es', 'fi', 'fj', 'fm', 'fr',
+  'ga', 'gb', 'gd', 'ge', 'gh', 'gm', 'gr', 'gt', 'gw', 'gy', 'hk', 'hn', 'hr',
+  'hu', 'id', 'ie', 'il', 'in', 'iq', 'is', 'it', 'jm', 'jo', 'jp', 'ke', 'kg',
+  'kh', 'kn', 'kr', 'kw', 'ky', 'kz', 'la', 'lb', 'lc', 'lk', 'lr', 'lt', 'lu',
+  'lv', 'ly', 'ma', 'md', 'me', 'mg', 'mk', 'ml', 'mm', 'mn', 'mo', 'mr', 'ms',
+  'mt', 'mu', 'mv', 'mw', 'mx', 'my', 'mz', 'na', 'ne', 'ng', 'ni', 'nl', 'no',
+  'np', 'nr', 'nz', 'om', 'pa', 'pe', 'pg', 'ph', 'pk', 'pl', 'pt', 'pw', 'py',
+  'qa', 'ro', 'rs', 'ru', 'rw', 'sa', 'sb', 'sc', 'se', 'sg', 'si', 'sk', 'sl',
+  'sn', 'sr', 'st', 'sv', 'sz', 'tc', 'td', 'th', 'tj', 'tm', 'tn', 'to', 'tr',
+  'tt', 'tw', 'tz', 'ua', 'ug', 'us', 'uy', 'uz', 'vc', 've', 'vg', 'vn', 'vu',
+  'xk', 'ye', 'za', 'zm', 'zw',
+]);
+
+/**
+ * Whether iTunes has a storefront for a country code.
+ *
+ * @param code an ISO 3166-1 alpha-2 code, in any case.
+ * @returns true when the storefront exists.
+ */
+export function validStorefront(code: string): boolean {
+  return STOREFRONTS.has(code.toLowerCase());
+}
+
+/**
+ * Parameters for the iTunes Search API.
+ */
+export interface SearchOptions {
+  term: string;
+  media: string;
+  entity?: string;
+  limit?: string;
+  offset?: string;
+  country?: string;
+}
+
+/**
+ * Builds an iTunes Search API URL.
+ *
+ * @param options the search parameters.
+ * @returns the upstream URL
+ */
+export function searchUrl(options: SearchOptions): string {
+  const url = new URL('/search', `https://${primaryHost()}`);
+
+  url.searchParams.set('media', options.media);
+  url.searchParams.set('term', options.term);
+
+  if (options.entity) {
+    url.searchParams.set('entity', options.entity);
+  }
+
+  if (options.limit) {
+    url.searchParams.set('limit', options.limit);
+  }
+
+  if (options.offset) {
+    url.searchParams.set('offset', options.offset);
+  }
+
+  if (options.country) {
+    url.searchParams.set('country', options.country);
+  }
+
+  return url.toString();
+}
+
+/**
+ * Parameters for the iTunes Lookup API.
+ */
+export interface LookupOptions {
+  id: string;
+  entity?: string;
+  country?: string;
+}
+
+/**
+ * Builds an iTunes Lookup API URL.
+ *
+ * @param options the lookup parameters.
+ * @returns the upstream URL
+ */
+export function lookupUrl(options: LookupOptions): string {
+  const url = new URL('/lookup', `https://${primaryHost()}`);
+
+  url.searchParams.set('id', options.id);
+
+  if (options.entity) {
+    url.searchParams.set('entity', options.entity);
+  }
+
+  if (options.country) {
+    url.searchParams.set('country', options.country);
+  }
+
+  return url.toString();
+}
@@ -0,0 +1,36 @@
+import { getVar } from './config';
+
+const LEVELS = {
+  debug: 0,
+  info: 1,
+  warn: 2,
+  error: 3,
+};
+
+export type Level = keyof typeof LEVELS;
+
+/**
+ * Emits a structured JSON log line, visible through `wrangler tail` and
+ * Logpush.
+ *
+ * Lines below `LOG_LEVEL` (default `info`) are dropped.
+ *
+ * @param level severity of the entry.
+ * @param msg short description of the event.
+ * @param fields additional fields to include.
+ */
+export function log(level: Level, msg: string, fields: Record<string, unknown> = {}): void {
+  const configured = (getVar('LOG_LEVEL') || 'info').toLowerCase() as Level;
+  const threshold = LEVELS[configured] ?? LEVELS.info;
+
+  if (LEVELS[level] < threshold) {
+    return;
+  }
+
+  console.log(JSON.stringify({
+    time: new Date().toISOString(),
+    level: level.toUpperCase(),
+    msg,
+    ...fields,
+  }));
+}
@@ -0,0 +1,332 @@
+import { getNumberVar, getVar } from './config';
+import { ipInList } from './ipfilter';
+import { log } from './logger';
+import { rateLimiter } from './ratelimit';
+import { errorResponse } from './response';
+import { urlStats } from './stats';
+import { endSpan, parseTraceparent, spanExporter, startServerSpan, Span } from './tracing';
+
+const DEFAULT_RATE_LIMIT_RPS = 10;
+const DEFAULT_RATE_LIMIT_BURST = 20;
+
+/**
+ * State shared between the middleware and the handler for one request.
+ */
+export interface RequestContext {
+  /** Correlates log lines with the response, echoed as `X-Request-ID`. */
+  requestId?: string;
+  /** The upstream URL fetched for this request, if any. */
+  upstreamUrl?: string;
+  /** The status returned by the upstream, if it was reached. */
+  upstreamStatus?: number;
+  /** The request's spans when it is traced, server span first. */
+  spans?: Span[];
+  /** Keeps the isolate alive for work that outlives the response. */
+  waitUntil?: (promise: Promise<unknown>) => void;
+}
+
+export type Handler = (request: Request, context: RequestContext) => Promise<Response>;
+
+/**
+ * Assigns each request an ID, reusing a well-formed incoming `X-Request-ID`
+ * or `CF-Ray` when present, and echoes it back as `X-Request-ID`.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withRequestId(handler: Handler): Handler {
+  return async (request, context) => {
+    const incoming = [request.headers.get('x-request-id'), request.headers.get('cf-ray')]
+      .find((id) => id && /^[\w.:-]{1,128}$/.test(id));
+
+    context.requestId = incoming || crypto.randomUUID();
+
+    const response = await handler(request, context);
+    response.headers.set('X-Request-ID', context.requestId);
+
+    return response;
+  };
+}
+
+/**
+ * Records an OpenTelemetry server span per request and exports the request's
+ * spans once it completes, continuing the trace from an incoming W3C
+ * `traceparent`. Requests whose parent isn't sampled aren't recorded.
+ *
+ * Tracing is off unless `OTEL_EXPORTER_OTLP_ENDPOINT` is set. Export runs
+ * after the response through `waitUntil`, and failures are only logged.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withTracing(handler: Handler): Handler {
+  return async (request, context) => {
+    const exporter = spanExporter();
+    const parent = parseTraceparent(request.headers.get('traceparent'));
+
+    if (!exporter || (parent && !parent.sampled)) {
+      return handler(request, context);
+    }
+
+    const { pathname } = new URL(request.url);
+    const span = startServerSpan(request.method, parent, {
+      'http.request.method': request.method,
+      'url.path': pathname,
+    });
+
+    context.spans = [span];
+
+    try {
+      const response = await handler(request, context);
+      endSpan(span, { 'http.response.status_code': response.status }, response.status >= 500);
+
+      return response;
+    } catch (err) {
+      endSpan(span, { 'error.type': err instanceof Error ? err.constructor.name : 'Error' }, true);
+      throw err;
+    } finally {
+      const exported = exporter.export(context.spans).catch((err) => {
+        log('warn', 'span export failed', { requestId: context.requestId, error: String(err) });
+      });
+
+      if (context.waitUntil) {
+        context.waitUntil(exported);
+      } else {
+        await exported;
+      }
+    }
+  };
+}
+
+/**
+ * Copies a body into a stream chunk by chunk, counting the bytes.
+ *
+ * @param body the body to copy.
+ * @param writable where to write it.
+ * @returns the number of bytes written, which is short of the whole body when
+ * the copy fails.
+ */
+async function copyCounting(body: ReadableStream, writable: WritableStream): Promise<number> {
+  const reader = body.getReader();
+  const writer = writable.getWriter();
+  let bytes = 0;
+
+  try {
+    for (;;) {
+      const { done, value } = await reader.read();
+
+      if (done) {
+        await writer.close();
+
+        return bytes;
+      }
+
+      await writer.write(value);
+      bytes += value.byteLength;
+    }
+  } catch (err) {
+    // The body failed or the client went away, so end both sides.
+    await reader.cancel(err).catch(() => undefined);
+    await writer.abort(err).catch(() => undefined);
+
+    return bytes;
+  }
+}
+
+/**
+ * Logs one line per request with its outcome and timing, and records it in
+ * the per-URL stats when an upstream URL was involved.
+ *
+ * The body is passed through as it streams, counting its bytes, so the line
+ * is written once the client has received the last of it, through
+ * `waitUntil`. `durationMs` is the time until the response started.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withLogging(handler: Handler): Handler {
+  return async (request, context) => {
+    const started = Date.now();
+    const response = await handler(request, context);
+    const durationMs = Date.now() - started;
+    const { pathname } = new URL(request.url);
+    const finish = (bytes: number) => {
+      if (context.upstreamUrl) {
+        urlStats.record(context.upstreamUrl, durationMs, bytes, response.status >= 500);
+      }
+
+      log('info', 'request', {
+        requestId: context.requestId,
+        method: request.method,
+        path: pathname,
+        upstreamUrl: context.upstreamUrl,
+        status: response.status,
+        upstreamStatus: context.upstreamStatus,
+        bytes,
+        durationMs,
+      });
+    };
+
+    if (!response.body) {
+      finish(0);
+
+      return response;
+    }
+
+    const { readable, writable } = new TransformStream();
+    const logged = copyCounting(response.body, writable).then(finish);
+
+    if (context.waitUntil) {
+      context.waitUntil(logged);
+    }
+
+    return new Response(readable, response);
+  };
+}
+
+/**
+ * Turns an exception thrown by the handler into a `500` JSON response,
+ * logging the stack trace so the failure isn't lost.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withRecovery(handler: Handler): Handler {
+  return async (request, context) => {
+    try {
+      return await handler(request, context);
+    } catch (err) {
+      log('error', 'unhandled exception', {
+        requestId: context.requestId,
+        error: String(err),
+        stack: err instanceof Error ? err.stack : undefined,
+      });
+
+      return errorResponse(500, 'internal_error', 'Internal server error');
+    }
+  };
+}
+
+/**
+ * Identifies the client, preferring the address Cloudflare saw.
+ *
+ * @param request the incoming request.
+ * @returns the client IP, or `unknown`.
+ */
+export function clientIp(request: Request): string {
+  const forwardedFor = request.headers.get('x-forwarded-for');
+
+  return request.headers.get('cf-connecting-ip')
+    || (forwardedFor && forwardedFor.split(',')[0].trim())
+    || 'unknown';
+}
+
+/**
+ * Blocks clients by address before any other work, answering `403`.
+ *
+ * `DENY_IPS` and `ALLOW_IPS` are comma-separated lists of addresses and CIDR
+ * ranges, IPv4 or IPv6. Clients matching `DENY_IPS` are blocked, and when
+ * `ALLOW_IPS` is set so is every client that doesn't match it. The client is
+ * identified as in `clientIp`. Both lists are read on each request, so a
+ * changed variable applies as soon as the new version is deployed.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withIpFilter(handler: Handler): Handler {
+  return async (request, context) => {
+    const ip = clientIp(request);
+    const deny = getVar('DENY_IPS');
+    const allow = getVar('ALLOW_IPS');
+
+    if ((deny && ipInList(ip, deny)) || (allow && !ipInList(ip, allow))) {
+      log('info', 'blocked client', { requestId: context.requestId, ip });
+
+      return errorResponse(403, 'forbidden', 'Forbidden');
+    }
+
+    return handler(request, context);
+  };
+}
+
+/**
+ * Limits each client to `RATE_LIMIT_RPS` requests per second with bursts of
+ * up to `RATE_LIMIT_BURST`, answering `429` with `Retry-After` beyond that.
+ * Setting `RATE_LIMIT_RPS=0` disables the limit.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withRateLimit(handler: Handler): Handler {
+  return async (request, context) => {
+    const rate = getNumberVar('RATE_LIMIT_RPS', DEFAULT_RATE_LIMIT_RPS);
+
+    if (rate === 0) {
+      return handler(request, context);
+    }
+
+    const retryAfter = rateLimiter.take(
+      clientIp(request),
+      rate,
+      getNumberVar('RATE_LIMIT_BURST', DEFAULT_RATE_LIMIT_BURST),
+    );
+
+    if (retryAfter > 0) {
+      const response = errorResponse(429, 'rate_limited', 'Too many requests');
+      response.headers.set('Retry-After', String(retryAfter));
+
+      return response;
+    }
+
+    return handler(request, context);
+  };
+}
+
+/**
+ * Resolves the `Access-Control-Allow-Origin` value for a request origin
+ * against `ALLOWED_ORIGINS`, a comma-separated list of origins or `*`
+ * (the default).
+ *
+ * @param origin the request's `Origin` header.
+ * @returns the value to send, or undefined when the origin isn't allowed.
+ */
+function allowedOrigin(origin: string | null): string | undefined {
+  const allowed = (getVar('ALLOWED_ORIGINS') || '*').split(',').map((entry) => entry.trim());
+
+  if (allowed.includes('*')) {
+    return '*';
+  }
+
+  return origin && allowed.includes(origin) ? origin : undefined;
+}
+
+/**
+ * Adds CORS headers for allowed origins and answers preflight requests
+ * before they reach the handler.
+ *
+ * @param handler the handler to wrap.
+ * @returns the wrapped handler.
+ */
+export function withCors(handler: Handler): Handler {
+  return async (request, context) => {
+    const origin = allowedOrigin(request.headers.get('origin'));
+    const isPreflight = request.method === 'OPTIONS' && request.headers.has('access-control-request-method');
+    const response = isPreflight ? new Response(null, { status: 204 }) : await handler(request, context);
+
+    if (origin) {
+      response.headers.set('Access-Control-Allow-Origin', origin);
+    }
+
+    if (origin !== '*') {
+      response.headers.append('Vary', 'Origin');
+    }
+
+    if (isPreflight && origin) {
+      response.headers.set('Access-Control-Allow-Methods', 'GET, HEAD, POST, OPTIONS');
+      response.headers.set('Access-Control-Allow-Headers', request.headers.get('access-control-request-headers') || '');
+      response.headers.set('Access-Control-Max-Age', '86400');
+    }
+
+    return response;
+  };
+}
@@ -0,0 +1,98 @@
+import { getNumberVar } from './config';
+import { MAX_LIMIT, SearchOptions, searchUrl } from './itunes';
+import { log } from './logger';
+import { errorResponse, headers } from './response';
+import { maxResponseBytes, ResponseTooLargeError, upstreamErrorResponse } from './upstream';
+
+const DEFAULT_SEARCH_MAX_PAGES = 5;
+
+/**
+ * The most results `searchAll` will return, given `SEARCH_MAX_PAGES`.
+ *
+ * @returns the result cap.
+ */
+export function maxSearchResults(): number {
+  return getNumberVar('SEARCH_MAX_PAGES', DEFAULT_SEARCH_MAX_PAGES) * MAX_LIMIT;
+}
+
+/**
+ * Fetches successive pages of a search using `limit` and `offset`, and
+ * merges their results into one response, dropping results whose `trackId`
+ * was already seen.
+ *
+ * Stops at a short page, once `max` results are collected, or after
+ * `SEARCH_MAX_PAGES` upstream requests. A failing page fails the whole
+ * search with that page's response, and so does a merged body that would
+ * grow past `MAX_RESPONSE_BYTES`, since each page is only checked on its own.
+ *
+ * @param options the search parameters; `limit` and `offset` are replaced.
+ * @param max the most results to return.
+ * @param fetchPage fetches an upstream URL through the proxy.
+ * @returns the merged response.
+ */
+export async function searchAll(
+  options: SearchOptions,
+  max: number,
+  fetchPage: (url: string) => Promise<Response>,
+): Promise<Response> {
+  const maxPages = getNumberVar('SEARCH_MAX_PAGES', DEFAULT_SEARCH_MAX_PAGES);
+  const maxBytes = maxResponseBytes();
+  const encoder = new TextEncoder();
+  const seen = new Set<unknown>();
+  const results: unknown[] = [];
+  // An upper bound on the merged body: `resultCount` never exceeds `max`, and
+  // each result adds its JSON and at most one separating comma.
+  let size = JSON.stringify({ resultCount: max, results: [] }).length;
+
+  for (let page = 0; page < maxPages && results.length < max; page++) {
+    const response = await fetchPage(searchUrl({
+      ...options,
+      limit: String(MAX_LIMIT),
+      offset: page ? String(page * MAX_LIMIT) : undefined,
+    }));
+    let pageResults: unknown[];
+
+    if (!response.ok) {
+      return response;
+    }
+
+    try {
+      const body = await response.json() as { results?: unknown };
+      pageResults = Array.isArray(body.results) ? body.results : [];
+    } catch {
+      return errorResponse(502, 'upstream_error', 'Upstream returned invalid JSON');
+    }
+
+    for (const result of pageResults) {
+      const trackId = result && (result as { trackId?: unknown }).trackId;
+
+      if (trackId !== undefined) {
+        if (seen.has(trackId)) {
+          continue;
+        }
+
+        seen.add(trackId);
+      }
+
+      size += encoder.encode(JSON.stringify(result)).byteLength + 1;
+
+      if (size > maxBytes) {
+        log('warn', 'merged search response too large', { maxBytes });
+
+        return upstreamErrorResponse(new ResponseTooLargeError(`Merged search results exceed ${maxBytes} bytes`));
+      }
+
+      results.push(result);
+
+      if (results.length >= max) {
+        break;
+      }
+    }
+
+    if (pageResults.length < MAX_LIMIT) {
+      break;
+    }
+  }
+
+  return new Response(JSON.stringify({ resultCount: results.length, results }), { headers });
+}
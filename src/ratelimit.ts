@@ -0,0 +1,70 @@
+interface Bucket {
+  tokens: number;
+  updated: number;
+}
+
+const SWEEP_INTERVAL_MS = 60 * 1000;
+
+/**
+ * Token bucket rate limiter keyed by client.
+ *
+ * Buckets live in the isolate's memory, so limits apply per isolate rather
+ * than globally. A bucket that has refilled completely is indistinguishable
+ * from a new one, so those are swept periodically to keep idle clients from
+ * accumulating.
+ */
+export class RateLimiter {
+  private buckets = new Map<string, Bucket>();
+  private lastSweep = 0;
+
+  /**
+   * Takes a token from the client's bucket.
+   *
+   * @param key identifies the client.
+   * @param rate tokens added per second.
+   * @param burst bucket capacity.
+   * @returns 0 when allowed, otherwise the seconds until a token is available.
+   */
+  take(key: string, rate: number, burst: number): number {
+    const now = Date.now();
+    this.sweep(now, rate, burst);
+
+    const bucket = this.buckets.get(key) || { tokens: burst, updated: now };
+
+    bucket.tokens = Math.min(burst, bucket.tokens + ((now - bucket.updated) / 1000) * rate);
+    bucket.updated = now;
+    this.buckets.set(key, bucket);
+
+    if (bucket.tokens >= 1) {
+      bucket.tokens -= 1;
+
+      return 0;
+    }
+
+    return Math.ceil((1 - bucket.tokens) / rate);
+  }
+
+  /**
+   * Removes every bucket.
+   */
+  clear(): void {
+    this.buckets.clear();
+    this.lastSweep = 0;
+  }
+
+  private sweep(now: number, rate: number, burst: number): void {
+    if (now - this.lastSweep < SWEEP_INTERVAL_MS) {
+      return;
+    }
+
+    this.lastSweep = now;
+
+    for (const [key, bucket] of this.buckets) {
+      if (bucket.tokens + ((now - bucket.updated) / 1000) * rate >= burst) {
+        this.buckets.delete(key);
+      }
+    }
+  }
+}
+
+export const rateLimiter = new RateLimiter();
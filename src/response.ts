@@ -0,0 +1,51 @@
+/**
+ * Headers applied to every JSON response sent to the client. CORS headers are
+ * added separately by `withCors`.
+ */
+export const headers = {
+  'content-type': 'application/json;charset=UTF-8',
+};
+
+/**
+ * Stable error codes clients can switch on.
+ */
+export type ErrorCode =
+  | 'batch_too_large'
+  | 'disallowed_url'
+  | 'forbidden'
+  | 'internal_error'
+  | 'invalid_body'
+  | 'invalid_country'
+  | 'invalid_dimensions'
+  | 'invalid_id'
+  | 'invalid_limit'
+  | 'invalid_url'
+  | 'method_not_allowed'
+  | 'missing_id'
+  | 'missing_url'
+  | 'missing_query'
+  | 'not_found'
+  | 'rate_limited'
+  | 'unauthorized'
+  | 'upstream_busy'
+  | 'upstream_error'
+  | 'upstream_redirect'
+  | 'upstream_timeout'
+  | 'upstream_unavailable'
+  | 'upstream_too_large';
+
+/**
+ * Builds a JSON error response of the form
+ * `{"error":{"code":"...","message":"..."}}`.
+ *
+ * @param status the HTTP status.
+ * @param code the error code.
+ * @param message a human readable description.
+ * @returns the error response.
+ */
+export function errorResponse(status: number, code: ErrorCode, message: string): Response {
+  return new Response(JSON.stringify({ error: { code, message } }), {
+    status,
+    headers,
+  });
+}
@@ -0,0 +1,88 @@
+/**
+ * Thrown when no slot frees up in time.
+ */
+export class ConcurrencyLimitError extends Error {}
+
+/**
+ * Counting semaphore for bounding concurrent work.
+ *
+ * Slots are handed straight to the next waiter on release, so queued callers
+ * are served in order.
+ */
+export class Semaphore {
+  private active = 0;
+  private waiters: (() => void)[] = [];
+
+  /**
+   * Acquires a slot, waiting up to `timeoutMs` when all are taken.
+   *
+   * @param limit the number of slots.
+   * @param timeoutMs how long to queue; 0 fails immediately.
+   * @returns releases the slot. Calling it more than once has no effect.
+   * @throws ConcurrencyLimitError when no slot is available in time.
+   */
+  async acquire(limit: number, timeoutMs: number): Promise<() => void> {
+    if (this.active < limit) {
+      this.active++;
+
+      return this.releaser();
+    }
+
+    if (timeoutMs <= 0) {
+      throw new ConcurrencyLimitError(`All ${limit} slots are in use`);
+    }
+
+    await new Promise<void>((resolve, reject) => {
+      const waiter = () => {
+        clearTimeout(timer);
+        resolve();
+      };
+      const timer = setTimeout(() => {
+        this.waiters.splice(this.waiters.indexOf(waiter), 1);
+        reject(new ConcurrencyLimitError(`No slot freed up within ${timeoutMs}ms`));
+      }, timeoutMs);
+
+      this.waiters.push(waiter);
+    });
+
+    return this.releaser();
+  }
+
+  /**
+   * Runs `fn` while holding a slot, releasing it however `fn` finishes.
+   *
+   * @param limit the number of slots.
+   * @param timeoutMs how long to queue; 0 fails immediately.
+   * @param fn the work to run.
+   * @returns the result of `fn`.
+   */
+  async run<T>(limit: number, timeoutMs: number, fn: () => Promise<T>): Promise<T> {
+    const release = await this.acquire(limit, timeoutMs);
+
+    try {
+      return await fn();
+    } finally {
+      release();
+    }
+  }
+
+  private releaser(): () => void {
+    let released = false;
+
+    return () => {
+      if (released) {
+        return;
+      }
+
+      released = true;
+
+      const next = this.waiters.shift();
+
+      if (next) {
+        next();
+      } else {
+        this.active--;
+      }
+    };
+  }
+}
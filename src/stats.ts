@@ -0,0 +1,108 @@
+import { requireToken } from './auth';
+import { getNumberVar } from './config';
+import { headers } from './response';
+
+const DEFAULT_STATS_MAX_URLS = 500;
+
+interface UrlStat {
+  count: number;
+  totalLatencyMs: number;
+  totalBytes: number;
+  errors: number;
+}
+
+/**
+ * Summary of the requests for one URL.
+ */
+export interface UrlSummary {
+  count: number;
+  avgLatencyMs: number;
+  avgBytes: number;
+  errors: number;
+}
+
+/**
+ * Per-URL request statistics since the isolate started.
+ *
+ * At most `STATS_MAX_URLS` URLs are tracked; the least recently requested
+ * ones are evicted beyond that. Like the cache, stats are kept per isolate.
+ */
+export class UrlStats {
+  private stats = new Map<string, UrlStat>();
+
+  /**
+   * Records a request for a URL.
+   *
+   * @param url the normalized upstream URL.
+   * @param latencyMs time taken to produce the response.
+   * @param bytes the response body size.
+   * @param error whether the request failed with a `5xx`.
+   */
+  record(url: string, latencyMs: number, bytes: number, error: boolean): void {
+    const stat = this.stats.get(url) || { count: 0, totalLatencyMs: 0, totalBytes: 0, errors: 0 };
+    const maxUrls = getNumberVar('STATS_MAX_URLS', DEFAULT_STATS_MAX_URLS);
+
+    stat.count++;
+    stat.totalLatencyMs += latencyMs;
+    stat.totalBytes += bytes;
+    stat.errors += error ? 1 : 0;
+
+    this.stats.delete(url);
+    this.stats.set(url, stat);
+
+    for (const oldest of this.stats.keys()) {
+      if (this.stats.size <= maxUrls) {
+        break;
+      }
+
+      this.stats.delete(oldest);
+    }
+  }
+
+  /**
+   * Summarizes the recorded requests.
+   *
+   * @returns averages and counts keyed by URL, most recently requested first.
+   */
+  summary(): Record<string, UrlSummary> {
+    const summary: Record<string, UrlSummary> = {};
+
+    [...this.stats].reverse().forEach(([url, stat]) => {
+      summary[url] = {
+        count: stat.count,
+        avgLatencyMs: Math.round(stat.totalLatencyMs / stat.count),
+        avgBytes: Math.round(stat.totalBytes / stat.count),
+        errors: stat.errors,
+      };
+    });
+
+    return summary;
+  }
+
+  /**
+   * Forgets every URL.
+   */
+  clear(): void {
+    this.stats.clear();
+  }
+}
+
+export const urlStats = new UrlStats();
+
+/**
+ * Debug view of `urlStats`, guarded by `DEBUG_TOKEN`.
+ *
+ * @param request the incoming request.
+ * @returns the stats as JSON, or an error when not authorized.
+ */
+export function handleStats(request: Request): Response {
+  const denied = requireToken(request, 'DEBUG_TOKEN');
+
+  if (denied) {
+    return denied;
+  }
+
+  return new Response(JSON.stringify(urlStats.summary()), {
+    headers: { ...headers, 'cache-control': 'no-store' },
+  });
+}
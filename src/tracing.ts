@@ -0,0 +1,252 @@
+import { getVar } from './config';
+import { RequestContext } from './middleware';
+
+/**
+ * A finished or in-progress unit of work in a trace.
+ */
+export interface Span {
+  traceId: string;
+  spanId: string;
+  parentSpanId?: string;
+  name: string;
+  kind: 'server' | 'client';
+  startTime: number;
+  endTime?: number;
+  attributes: Record<string, string | number>;
+  error?: boolean;
+}
+
+/**
+ * Receives the spans of a request once it completes.
+ */
+export interface SpanExporter {
+  export(spans: Span[]): Promise<void>;
+}
+
+/**
+ * The parent span from an incoming W3C `traceparent` header.
+ */
+export interface TraceParent {
+  traceId: string;
+  spanId: string;
+  sampled: boolean;
+}
+
+type AnyValue = { stringValue: string } | { intValue: number } | { doubleValue: number };
+
+const SPAN_KINDS = { server: 2, client: 3 };
+const STATUS_ERROR = 2;
+
+/**
+ * Generates a random lowercase hex ID.
+ *
+ * @param bytes the ID length in bytes.
+ * @returns the hex ID.
+ */
+function randomId(bytes: number): string {
+  return Array.from(crypto.getRandomValues(new Uint8Array(bytes)))
+    .map((byte) => byte.toString(16).padStart(2, '0'))
+    .join('');
+}
+
+/**
+ * Parses a W3C `traceparent` header.
+ *
+ * Unknown future versions are accepted as long as the fields we know about
+ * are well-formed, as the spec requires.
+ *
+ * @param header the header value.
+ * @returns the parent span, or undefined when absent or malformed.
+ */
+export function parseTraceparent(header: string | null): TraceParent | undefined {
+  const match = header && /^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$/.exec(header.trim());
+
+  if (!match) {
+    return undefined;
+  }
+
+  const [, version, traceId, spanId, flags, rest] = match;
+
+  if (version === 'ff' || (version === '00' && rest) || /^0+$/.test(traceId) || /^0+$/.test(spanId)) {
+    return undefined;
+  }
+
+  return { traceId, spanId, sampled: (parseInt(flags, 16) & 1) === 1 };
+}
+
+/**
+ * Exports spans as OTLP/HTTP JSON to `OTEL_EXPORTER_OTLP_ENDPOINT`.
+ *
+ * `OTEL_EXPORTER_OTLP_HEADERS` takes comma-separated `name=value` pairs, e.g.
+ * for an API key, and `OTEL_SERVICE_NAME` defaults to `podr-service`.
+ */
+class OtlpExporter implements SpanExporter {
+  constructor(private readonly endpoint: string) {}
+
+  async export(spans: Span[]): Promise<void> {
+    const headers = new Headers({ 'content-type': 'application/json' });
+
+    (getVar('OTEL_EXPORTER_OTLP_HEADERS') || '').split(',').forEach((pair) => {
+      const index = pair.indexOf('=');
+
+      if (index > 0) {
+        headers.set(pair.slice(0, index).trim(), decodeURIComponent(pair.slice(index + 1).trim()));
+      }
+    });
+
+    const response = await fetch(`${this.endpoint.replace(/\/+$/, '')}/v1/traces`, {
+      method: 'POST',
+      headers,
+      body: JSON.stringify({
+        resourceSpans: [{
+          resource: { attributes: toAttributes({ 'service.name': getVar('OTEL_SERVICE_NAME') || 'podr-service' }) },
+          scopeSpans: [{ scope: { name: 'podr-service' }, spans: spans.map(toOtlpSpan) }],
+        }],
+      }),
+    });
+
+    if (!response.ok) {
+      throw new Error(`OTLP export failed with status ${response.status}`);
+    }
+  }
+}
+
+/**
+ * Converts span attributes to OTLP key/value pairs.
+ *
+ * @param attributes the attributes.
+ * @returns the OTLP attribute list.
+ */
+function toAttributes(attributes: Record<string, string | number>): { key: string; value: AnyValue }[] {
+  return Object.entries(attributes).map(([key, value]) => ({
+    key,
+    value: typeof value === 'string'
+      ? { stringValue: value }
+      : Number.isInteger(value) ? { intValue: value } : { doubleValue: value },
+  }));
+}
+
+/**
+ * Converts a span to its OTLP JSON form. Times are milliseconds, so the
+ * nanosecond strings are built by appending zeros to stay exact.
+ *
+ * @param span the span.
+ * @returns the OTLP span.
+ */
+function toOtlpSpan(span: Span): Record<string, unknown> {
+  return {
+    traceId: span.traceId,
+    spanId: span.spanId,
+    parentSpanId: span.parentSpanId,
+    name: span.name,
+    kind: SPAN_KINDS[span.kind],
+    startTimeUnixNano: `${span.startTime}000000`,
+    endTimeUnixNano: `${span.endTime ?? span.startTime}000000`,
+    attributes: toAttributes(span.attributes),
+    status: span.error ? { code: STATUS_ERROR } : {},
+  };
+}
+
+let exporterOverride: SpanExporter | undefined;
+
+/**
+ * Replaces the exporter configured from the environment, e.g. with an
+ * in-memory one in tests.
+ *
+ * @param exporter the exporter, or undefined to go back to the environment.
+ */
+export function setSpanExporter(exporter: SpanExporter | undefined): void {
+  exporterOverride = exporter;
+}
+
+/**
+ * The exporter to use. Tracing is off when `OTEL_EXPORTER_OTLP_ENDPOINT` is
+ * unset.
+ *
+ * @returns the exporter, or undefined when tracing is off.
+ */
+export function spanExporter(): SpanExporter | undefined {
+  const endpoint = getVar('OTEL_EXPORTER_OTLP_ENDPOINT');
+
+  return exporterOverride || (endpoint ? new OtlpExporter(endpoint) : undefined);
+}
+
+/**
+ * Starts the server span for a request, continuing the incoming trace when
+ * there is one.
+ *
+ * @param name the span name.
+ * @param parent the incoming parent span, if any.
+ * @param attributes initial attributes.
+ * @returns the span.
+ */
+export function startServerSpan(
+  name: string,
+  parent: TraceParent | undefined,
+  attributes: Record<string, string | number>,
+): Span {
+  return {
+    traceId: parent ? parent.traceId : randomId(16),
+    spanId: randomId(8),
+    parentSpanId: parent && parent.spanId,
+    name,
+    kind: 'server',
+    startTime: Date.now(),
+    attributes,
+  };
+}
+
+/**
+ * Starts a client span under the request's server span. Does nothing when
+ * the request isn't traced.
+ *
+ * @param context the request context holding the trace.
+ * @param name the span name.
+ * @param attributes initial attributes.
+ * @returns the span, or undefined when the request isn't traced.
+ */
+export function startSpan(
+  context: RequestContext,
+  name: string,
+  attributes: Record<string, string | number>,
+): Span | undefined {
+  if (!context.spans || !context.spans.length) {
+    return undefined;
+  }
+
+  const [root] = context.spans;
+  const span: Span = {
+    traceId: root.traceId,
+    spanId: randomId(8),
+    parentSpanId: root.spanId,
+    name,
+    kind: 'client',
+    startTime: Date.now(),
+    attributes,
+  };
+
+  context.spans.push(span);
+
+  return span;
+}
+
+/**
+ * Ends a span.
+ *
+ * @param span the span, if one was started.
+ * @param attributes attributes to add.
+ * @param error whether the work failed.
+ */
+export function endSpan(
+  span: Span | undefined,
+  attributes: Record<string, string | number> = {},
+  error = false,
+): void {
+  if (!span) {
+    return;
+  }
+
+  Object.assign(span.attributes, attributes);
+  span.endTime = Date.now();
+  span.error = error;
+}
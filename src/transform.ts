@@ -0,0 +1,48 @@
+import { getVar } from './config';
+import { BufferedResponse } from './upstream';
+
+/**
+ * Removes the keys listed in `STRIP_FIELDS`, a comma-separated list, from
+ * each object in a JSON response's `results`, e.g. affiliate URLs.
+ *
+ * Non-JSON responses and bodies that don't parse are returned unchanged, as
+ * is everything outside `results`. The body is already bounded by
+ * `MAX_RESPONSE_BYTES` when it reaches here.
+ *
+ * @param response the buffered upstream response.
+ * @returns the response with the fields removed.
+ */
+export function stripFields(response: BufferedResponse): BufferedResponse {
+  const fields = (getVar('STRIP_FIELDS') || '').split(',').map((field) => field.trim()).filter(Boolean);
+  const contentType = new Headers(response.headers).get('content-type') || '';
+
+  if (!fields.length || !/^application\/json/i.test(contentType)) {
+    return response;
+  }
+
+  let body: unknown;
+
+  try {
+    body = JSON.parse(new TextDecoder().decode(response.body));
+  } catch {
+    return response;
+  }
+
+  const results = body && (body as { results?: unknown }).results;
+
+  if (!Array.isArray(results)) {
+    return response;
+  }
+
+  results.forEach((result) => {
+    if (result && typeof result === 'object') {
+      fields.forEach((field) => delete (result as Record<string, unknown>)[field]);
+    }
+  });
+
+  return {
+    ...response,
+    headers: response.headers.filter(([name]) => name.toLowerCase() !== 'content-length'),
+    body: new TextEncoder().encode(JSON.stringify(body)).buffer,
+  };
+}
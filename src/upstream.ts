@@ -0,0 +1,468 @@
+import { circuitBreaker, CircuitOpenError } from './breaker';
+import { getNumberVar, getVar } from './config';
+import { primaryHost, secondaryHost } from './itunes';
+import { log } from './logger';
+import { errorResponse, headers } from './response';
+import { ConcurrencyLimitError, Semaphore } from './semaphore';
+import { isAllowedUpstream } from './url';
+
+const DEFAULT_FETCH_TIMEOUT_MS = 10000;
+const DEFAULT_MAX_RESPONSE_BYTES = 10 * 1024 * 1024;
+const DEFAULT_MAX_RETRIES = 2;
+const DEFAULT_RETRY_BUDGET_MS = 3000;
+const DEFAULT_MAX_REDIRECTS = 5;
+const DEFAULT_MAX_CONCURRENT_FETCHES = 50;
+const DEFAULT_FETCH_QUEUE_TIMEOUT_MS = 2000;
+const DEFAULT_USER_AGENT = 'podr-service/1.0';
+const RETRY_BASE_DELAY_MS = 100;
+
+const REDIRECT_STATUSES = [301, 302, 303, 307, 308];
+
+/**
+ * Upstream statuses worth retrying, since they usually mean a transient
+ * iTunes or edge failure.
+ */
+const RETRY_STATUSES = [502, 503, 504];
+
+/**
+ * Hop-by-hop headers (RFC 7230 section 6.1) describe the upstream connection
+ * and must not be forwarded to the client.
+ */
+const HOP_BY_HOP_HEADERS = [
+  'connection',
+  'keep-alive',
+  'proxy-authenticate',
+  'proxy-authorization',
+  'te',
+  'trailer',
+  'transfer-encoding',
+  'upgrade',
+];
+
+/**
+ * An upstream response with its body read into memory, so it can be replayed
+ * to several clients.
+ */
+export interface BufferedResponse {
+  status: number;
+  headers: [string, string][];
+  body: ArrayBuffer;
+}
+
+/**
+ * Thrown when the upstream does not respond within `FETCH_TIMEOUT_MS`.
+ */
+export class TimeoutError extends Error {}
+
+/**
+ * Thrown when the upstream body is larger than `MAX_RESPONSE_BYTES`.
+ */
+export class ResponseTooLargeError extends Error {}
+
+/**
+ * Thrown when the upstream redirects to a host outside `ALLOWED_HOSTS`, or
+ * redirects more than `MAX_REDIRECTS` times.
+ */
+export class RedirectError extends Error {}
+
+/**
+ * Fetches currently in flight, keyed by method and cache key.
+ */
+const inflight = new Map<string, Promise<BufferedResponse>>();
+
+/**
+ * Bounds the number of shared fetches running against iTunes at once.
+ */
+const fetchSlots = new Semaphore();
+
+/**
+ * Copies the upstream response headers, dropping hop-by-hop headers.
+ * `Set-Cookie` is dropped too, so iTunes can't set cookies on our domain,
+ * unless `FORWARD_COOKIES=true`.
+ *
+ * Successful responses get our JSON content type. Anything else keeps the
+ * upstream's headers untouched, so error payloads arrive as iTunes sent them.
+ *
+ * @param response the upstream response.
+ * @returns headers for the client response.
+ */
+function forwardHeaders(response: Response): [string, string][] {
+  const upstream = response.headers;
+  const forwarded = new Headers(upstream);
+  const connectionHeaders = (upstream.get('connection') || '')
+    .split(',')
+    .map((name) => name.trim())
+    .filter(Boolean);
+
+  [...HOP_BY_HOP_HEADERS, ...connectionHeaders].forEach((name) => forwarded.delete(name));
+
+  if (getVar('FORWARD_COOKIES') !== 'true') {
+    forwarded.delete('set-cookie');
+  }
+
+  if (response.ok) {
+    Object.entries(headers).forEach(([name, value]) => forwarded.set(name, value));
+  }
+
+  const entries: [string, string][] = [];
+  forwarded.forEach((value, name) => entries.push([name, value]));
+
+  return entries;
+}
+
+/**
+ * Fetches a URL, following redirects only while they stay on allowed hosts.
+ *
+ * @param url the URL to fetch.
+ * @param init request options.
+ * @returns the final response.
+ * @throws RedirectError when a redirect is rejected.
+ */
+async function fetchFollowingRedirects(url: string, init: RequestInit): Promise<Response> {
+  const maxRedirects = getNumberVar('MAX_REDIRECTS', DEFAULT_MAX_REDIRECTS);
+  let current = url;
+
+  for (let redirects = 0; ; redirects++) {
+    const response = await fetch(current, { ...init, redirect: 'manual' });
+    const location = response.headers.get('location');
+
+    if (!REDIRECT_STATUSES.includes(response.status) || !location) {
+      return response;
+    }
+
+    const next = new URL(location, current);
+
+    if (redirects >= maxRedirects) {
+      throw new RedirectError(`Upstream redirected more than ${maxRedirects} times`);
+    }
+
+    if (!isAllowedUpstream(next)) {
+      throw new RedirectError(`Upstream redirected to disallowed host ${next.host}`);
+    }
+
+    current = next.toString();
+  }
+}
+
+/**
+ * Fetches a URL and reads the response, aborting once `FETCH_TIMEOUT_MS`
+ * elapses. The deadline ends when `read` returns, so a body `read` hands back
+ * unread is not covered by it.
+ *
+ * Requests identify themselves with `UPSTREAM_USER_AGENT` (default
+ * `podr-service/1.0`) and ask for JSON unless `init` says otherwise.
+ *
+ * @param url the URL to fetch.
+ * @param read reads what the caller needs from the response.
+ * @param init extra request options.
+ * @returns the result of `read`.
+ * @throws TimeoutError when the timeout elapses first.
+ * @throws RedirectError when a redirect is rejected.
+ */
+export async function fetchWithTimeout<T>(
+  url: string,
+  read: (response: Response) => Promise<T>,
+  init: RequestInit = {},
+): Promise<T> {
+  const controller = new AbortController();
+  const timeout = setTimeout(
+    () => controller.abort(),
+    getNumberVar('FETCH_TIMEOUT_MS', DEFAULT_FETCH_TIMEOUT_MS),
+  );
+
+  const requestHeaders = new Headers(init.headers);
+
+  if (!requestHeaders.has('user-agent')) {
+    requestHeaders.set('User-Agent', getVar('UPSTREAM_USER_AGENT') || DEFAULT_USER_AGENT);
+  }
+
+  if (!requestHeaders.has('accept')) {
+    requestHeaders.set('Accept', 'application/json');
+  }
+
+  try {
+    const response = await fetchFollowingRedirects(url, {
+      ...init,
+      headers: requestHeaders,
+      signal: controller.signal,
+    });
+
+    return await read(response);
+  } catch (err) {
+    if (controller.signal.aborted) {
+      throw new TimeoutError('Upstream request timed out');
+    }
+
+    throw err;
+  } finally {
+    clearTimeout(timeout);
+  }
+}
+
+/**
+ * The largest response body the worker will hold in memory.
+ *
+ * @returns `MAX_RESPONSE_BYTES`, or 10 MiB by default.
+ */
+export function maxResponseBytes(): number {
+  return getNumberVar('MAX_RESPONSE_BYTES', DEFAULT_MAX_RESPONSE_BYTES);
+}
+
+/**
+ * Reads a response body, giving up as soon as it exceeds `MAX_RESPONSE_BYTES`.
+ *
+ * @param url the upstream URL, for logging.
+ * @param response the upstream response.
+ * @returns the body.
+ * @throws ResponseTooLargeError when the body is too large.
+ */
+async function readBody(url: string, response: Response): Promise<ArrayBuffer> {
+  const maxBytes = maxResponseBytes();
+  const tooLarge = () => {
+    log('warn', 'upstream response too large', { upstreamUrl: url, maxBytes });
+
+    return new ResponseTooLargeError(`Upstream response exceeds ${maxBytes} bytes`);
+  };
+
+  if (Number(response.headers.get('content-length')) > maxBytes) {
+    throw tooLarge();
+  }
+
+  if (!response.body) {
+    return new ArrayBuffer(0);
+  }
+
+  const reader = response.body.getReader();
+  const chunks: Uint8Array[] = [];
+  let total = 0;
+
+  for (;;) {
+    const { done, value } = await reader.read();
+
+    if (done) {
+      break;
+    }
+
+    total += value.byteLength;
+
+    if (total > maxBytes) {
+      await reader.cancel();
+      throw tooLarge();
+    }
+
+    chunks.push(value);
+  }
+
+  const body = new Uint8Array(total);
+  let offset = 0;
+
+  for (const chunk of chunks) {
+    body.set(chunk, offset);
+    offset += chunk.byteLength;
+  }
+
+  return body.buffer;
+}
+
+/**
+ * Fetches an upstream URL and buffers the response.
+ *
+ * @param url the upstream URL.
+ * @param init request options; a `HEAD` method skips the body.
+ * @returns the buffered response.
+ */
+function fetchUpstream(url: string, init: RequestInit): Promise<BufferedResponse> {
+  return fetchWithTimeout(url, async (response) => ({
+    status: response.status,
+    headers: forwardHeaders(response),
+    body: init.method === 'HEAD' ? new ArrayBuffer(0) : await readBody(url, response),
+  }), init);
+}
+
+/**
+ * Fetches an upstream URL, retrying connection errors and `502`/`503`/`504`
+ * responses up to `MAX_RETRIES` times with exponential backoff and jitter.
+ *
+ * Retries stop early once the next delay would push the total time past
+ * `RETRY_BUDGET_MS`. Timeouts, oversized bodies and rejected redirects are
+ * never retried, and neither are `4xx` responses. When retries run out the
+ * last response or error is returned to the caller.
+ *
+ * @param url the upstream URL.
+ * @param init request options.
+ * @returns the buffered response.
+ */
+async function fetchWithRetry(url: string, init: RequestInit): Promise<BufferedResponse> {
+  const maxRetries = getNumberVar('MAX_RETRIES', DEFAULT_MAX_RETRIES);
+  const budget = getNumberVar('RETRY_BUDGET_MS', DEFAULT_RETRY_BUDGET_MS);
+  const started = Date.now();
+
+  for (let attempt = 0; ; attempt++) {
+    const delay = RETRY_BASE_DELAY_MS * 2 ** attempt * (1 + Math.random());
+    const canRetry = attempt < maxRetries && Date.now() - started + delay <= budget;
+    let reason: string;
+
+    try {
+      const response = await fetchUpstream(url, init);
+
+      if (!canRetry || !RETRY_STATUSES.includes(response.status)) {
+        return response;
+      }
+
+      reason = `status ${response.status}`;
+    } catch (err) {
+      if (
+        !canRetry
+        || err instanceof TimeoutError
+        || err instanceof ResponseTooLargeError
+        || err instanceof RedirectError
+      ) {
+        throw err;
+      }
+
+      reason = String(err);
+    }
+
+    log('warn', 'retrying upstream request', {
+      upstreamUrl: url,
+      attempt: attempt + 1,
+      reason,
+      delayMs: Math.round(delay),
+    });
+    await new Promise((resolve) => setTimeout(resolve, delay));
+  }
+}
+
+/**
+ * Fetches an upstream URL through the circuit breaker, failing over to
+ * `UPSTREAM_SECONDARY` when the URL is on the primary host and the primary
+ * still answers `5xx`, can't be reached after retries, or has its circuit
+ * open. Only the host is rewritten. The secondary isn't tracked by the
+ * breaker.
+ *
+ * The host that served the response is reported in `X-Upstream-Used`.
+ *
+ * @param url the upstream URL.
+ * @param init request options.
+ * @returns the buffered response.
+ */
+async function fetchWithFailover(url: string, init: RequestInit): Promise<BufferedResponse> {
+  const parsed = new URL(url);
+  const secondary = secondaryHost();
+  const canFailOver = !!secondary && parsed.hostname === primaryHost();
+  const served = (response: BufferedResponse, host: string): BufferedResponse => ({
+    ...response,
+    headers: [...response.headers, ['x-upstream-used', host]],
+  });
+
+  try {
+    const response = await circuitBreaker.run(() => fetchWithRetry(url, init), (result) => result.status >= 500);
+
+    if (!canFailOver || response.status < 500) {
+      return served(response, parsed.hostname);
+    }
+  } catch (err) {
+    if (
+      !canFailOver
+      || err instanceof TimeoutError
+      || err instanceof ResponseTooLargeError
+      || err instanceof RedirectError
+    ) {
+      throw err;
+    }
+
+    if (!(err instanceof CircuitOpenError)) {
+      log('warn', 'primary upstream failed', { upstreamUrl: url, error: String(err) });
+    }
+  }
+
+  parsed.hostname = secondary as string;
+
+  return served(await fetchWithRetry(parsed.toString(), init), parsed.hostname);
+}
+
+/**
+ * Fetches an upstream URL, sharing a single upstream call between concurrent
+ * callers for the same URL. Failures are propagated to every caller and the
+ * next call after a failure fetches again. Each shared call goes through the
+ * circuit breaker, with errors and `5xx` responses counted as failures, and
+ * may fail over to the secondary upstream.
+ *
+ * At most `MAX_CONCURRENT_FETCHES` shared fetches run at once. Beyond that,
+ * callers wait up to `FETCH_QUEUE_TIMEOUT_MS` for a slot, or fail immediately
+ * when `FETCH_QUEUE_MODE=reject`, with a `ConcurrencyLimitError`.
+ *
+ * @param key identifies the response; must cover any request headers in `init`
+ * that change it.
+ * @param url the upstream URL.
+ * @param init request options. Fetches are only shared with the same method.
+ * @returns the buffered response.
+ */
+export function sharedFetch(key: string, url: string, init: RequestInit = {}): Promise<BufferedResponse> {
+  const inflightKey = `${init.method || 'GET'} ${key}`;
+  let pending = inflight.get(inflightKey);
+
+  if (!pending) {
+    pending = withFetchSlot(() => fetchWithFailover(url, init)).finally(() => inflight.delete(inflightKey));
+    inflight.set(inflightKey, pending);
+  }
+
+  return pending;
+}
+
+/**
+ * Runs an upstream fetch in one of the `MAX_CONCURRENT_FETCHES` slots, queueing
+ * for up to `FETCH_QUEUE_TIMEOUT_MS` when all are taken, or failing at once
+ * when `FETCH_QUEUE_MODE=reject`.
+ *
+ * @param fn the fetch to run.
+ * @returns the result of `fn`.
+ * @throws ConcurrencyLimitError when no slot is available in time.
+ */
+export function withFetchSlot<T>(fn: () => Promise<T>): Promise<T> {
+  const queueTimeout = getVar('FETCH_QUEUE_MODE') === 'reject'
+    ? 0
+    : getNumberVar('FETCH_QUEUE_TIMEOUT_MS', DEFAULT_FETCH_QUEUE_TIMEOUT_MS);
+
+  return fetchSlots.run(getNumberVar('MAX_CONCURRENT_FETCHES', DEFAULT_MAX_CONCURRENT_FETCHES), queueTimeout, fn);
+}
+
+/**
+ * Maps an upstream fetch failure to the error response sent to the client.
+ *
+ * A timeout is a `504 Gateway Timeout`, an open circuit or a full fetch queue
+ * a `503 Service Unavailable` with `Retry-After`, and anything else, including
+ * an oversized body or a rejected redirect, a `502 Bad Gateway`.
+ *
+ * @param err the error thrown by the fetch.
+ * @returns the error response.
+ */
+export function upstreamErrorResponse(err: unknown): Response {
+  if (err instanceof TimeoutError) {
+    return errorResponse(504, 'upstream_timeout', 'Upstream request timed out');
+  }
+
+  if (err instanceof CircuitOpenError) {
+    const response = errorResponse(503, 'upstream_unavailable', 'iTunes is unavailable, try again later');
+    response.headers.set('Retry-After', String(err.retryAfter));
+
+    return response;
+  }
+
+  if (err instanceof ConcurrencyLimitError) {
+    const response = errorResponse(503, 'upstream_busy', 'Too many upstream requests in flight, try again later');
+    response.headers.set('Retry-After', '1');
+
+    return response;
+  }
+
+  if (err instanceof ResponseTooLargeError) {
+    return errorResponse(502, 'upstream_too_large', err.message);
+  }
+
+  if (err instanceof RedirectError) {
+    return errorResponse(502, 'upstream_redirect', err.message);
+  }
+
+  return errorResponse(502, 'upstream_error', 'Upstream request failed');
+}
@@ -0,0 +1,95 @@
+import { getVar } from './config';
+
+const DEFAULT_ALLOWED_HOSTS = 'itunes.apple.com,*.mzstatic.com';
+
+/**
+ * Query params that only carry Apple affiliate or campaign tracking and don't
+ * change the response.
+ */
+const TRACKING_PARAMS = ['at', 'ct', 'itscg', 'itsct'];
+
+/**
+ * Normalizes an upstream URL into a canonical string, so equivalent URLs
+ * share cache entries and log the same way.
+ *
+ * The host is lowercased and default ports dropped (both done by the URL
+ * parser), tracking params and fragments are removed and the remaining params
+ * are sorted by name. Params with the same name keep their relative order,
+ * and empty values are kept.
+ *
+ * @param url an absolute URL.
+ * @returns the canonical form.
+ */
+export function normalizeURL(url: string): string {
+  const parsed = new URL(url);
+
+  TRACKING_PARAMS.forEach((name) => parsed.searchParams.delete(name));
+  parsed.searchParams.sort();
+  parsed.hash = '';
+
+  return parsed.toString();
+}
+
+/**
+ * Parses a URL passed as a query param.
+ *
+ * `URLSearchParams` has already decoded the value once. Clients that encode
+ * it twice send e.g. `https%3A%2F%2F...`, which is decoded one more time;
+ * anything that still isn't an absolute http(s) URL after that pass is
+ * rejected rather than decoded again. The result is parsed, and so
+ * normalized, by the URL parser, and still has to pass `isAllowedUpstream`.
+ *
+ * @param value the param value.
+ * @returns the parsed URL, or undefined when it isn't an absolute http(s) URL.
+ */
+export function parseUrlParam(value: string): URL | undefined {
+  let decoded = value.trim();
+
+  if (/^https?%3a/i.test(decoded)) {
+    try {
+      decoded = decodeURIComponent(decoded);
+    } catch {
+      return undefined;
+    }
+  }
+
+  if (!/^https?:\/\//i.test(decoded)) {
+    return undefined;
+  }
+
+  try {
+    return new URL(decoded);
+  } catch {
+    return undefined;
+  }
+}
+
+/**
+ * Whether the worker may fetch a URL.
+ *
+ * Only `https` URLs on the default port and without credentials are allowed,
+ * and the host must match `ALLOWED_HOSTS`, a comma-separated list where
+ * `*.example.com` matches any subdomain of `example.com`. Hosts set in
+ * `UPSTREAM_PRIMARY` and `UPSTREAM_SECONDARY` are always allowed.
+ *
+ * @param url the URL to check.
+ * @returns true when the URL may be fetched.
+ */
+export function isAllowedUpstream(url: URL): boolean {
+  if (url.protocol !== 'https:' || url.port !== '' || url.username !== '' || url.password !== '') {
+    return false;
+  }
+
+  const host = url.hostname;
+
+  const upstreams = [getVar('UPSTREAM_PRIMARY'), getVar('UPSTREAM_SECONDARY')];
+
+  if (upstreams.some((entry) => entry && entry.toLowerCase() === host)) {
+    return true;
+  }
+
+  return (getVar('ALLOWED_HOSTS') || DEFAULT_ALLOWED_HOSTS)
+    .split(',')
+    .map((entry) => entry.trim().toLowerCase())
+    .some((entry) => entry.startsWith('*.') ? host.endsWith(entry.slice(1)) : host === entry);
+}
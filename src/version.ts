@@ -0,0 +1,33 @@
+import { headers } from './response';
+
+/*
+ * Build metadata, replaced at build time by webpack's DefinePlugin. They are
+ * undefined when the code isn't bundled, e.g. under jest.
+ */
+declare const __GIT_COMMIT__: string | undefined;
+declare const __BUILD_TIME__: string | undefined;
+declare const __NODE_VERSION__: string | undefined;
+
+/**
+ * Falls back to `unknown` for missing or empty build metadata.
+ *
+ * @param value the build-time value.
+ * @returns the value, or `unknown`.
+ */
+function orUnknown(value: string | undefined): string {
+  return value || 'unknown';
+}
+
+/**
+ * Reports which build is running.
+ *
+ * @returns `200 OK` with the git commit, build time and the Node.js version
+ * the bundle was built with.
+ */
+export function handleVersion(): Response {
+  return new Response(JSON.stringify({
+    commit: orUnknown(typeof __GIT_COMMIT__ !== 'undefined' ? __GIT_COMMIT__ : undefined),
+    buildTime: orUnknown(typeof __BUILD_TIME__ !== 'undefined' ? __BUILD_TIME__ : undefined),
+    nodeVersion: orUnknown(typeof __NODE_VERSION__ !== 'undefined' ? __NODE_VERSION__ : undefined),
+  }), { headers });
+}
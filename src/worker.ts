@@ -0,0 +1,19 @@
+import { handleRequest } from './handler';
+import {
+  withCors,
+  withIpFilter,
+  withLogging,
+  withRateLimit,
+  withRecovery,
+  withRequestId,
+  withTracing,
+} from './middleware';
+
+/**
+ * The request handler wrapped in its middleware, outermost first. Blocked
+ * clients are turned away before CORS, so they don't get preflight answers
+ * either, but are still logged.
+ */
+export const handler = withRequestId(
+  withTracing(withLogging(withIpFilter(withCors(withRecovery(withRateLimit(handleRequest)))))),
+);
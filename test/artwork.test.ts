@@ -0,0 +1,206 @@
+import { handleRequest } from '../src/handler'
+import makeServiceWorkerEnv from 'service-worker-mock'
+
+declare var global: any
+
+const ARTWORK =
+  'https://is1-ssl.mzstatic.com/image/thumb/Podcasts/ab/cd/600x600bb.jpg'
+
+describe('artwork', () => {
+  beforeEach(() => {
+    Object.assign(global, makeServiceWorkerEnv())
+    jest.resetModules()
+  })
+
+  afterEach(() => {
+    delete global.ARTWORK_MAX_DIMENSION
+    delete global.FETCH_TIMEOUT_MS
+    delete global.MAX_CONCURRENT_FETCHES
+    delete global.FETCH_QUEUE_MODE
+  })
+
+  test('resizes mzstatic artwork preserving aspect ratio', async () => {
+    global.fetch = jest.fn(
+      async () =>
+        new Response('jpeg bytes', {
+          headers: {
+            'Content-Type': 'image/jpeg',
+            'cf-resized': 'internal=ok/- q=0 n=12',
+          },
+        }),
+    )
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}&w=300&h=200`,
+      ),
+    )
+    expect(result.status).toEqual(200)
+    expect(result.headers.get('Content-Type')).toEqual('image/jpeg')
+    expect(result.headers.get('Cache-Control')).toEqual(
+      'public, max-age=2592000, immutable',
+    )
+    expect(await result.text()).toEqual('jpeg bytes')
+    expect(global.fetch.mock.calls[0][0]).toEqual(ARTWORK)
+    expect(global.fetch.mock.calls[0][1].cf).toEqual({
+      image: { width: 300, height: 200, fit: 'scale-down' },
+    })
+  })
+
+  test('skips Image Resizing when no size is given', async () => {
+    global.fetch = jest.fn(async () => new Response('jpeg bytes'))
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}`,
+      ),
+    )
+    expect(result.status).toEqual(200)
+    expect(global.fetch.mock.calls[0][1].cf).toBeUndefined()
+  })
+
+  test.each([
+    ['no resize was asked for', '', {}, 'public, max-age=2592000, immutable'],
+    ['resizing was skipped', '&w=300', {}, 'public, max-age=300'],
+    [
+      'resizing failed',
+      '&w=300',
+      { 'cf-resized': 'err=9401' },
+      'public, max-age=300',
+    ],
+  ])(
+    'sets Cache-Control when %s',
+    async (_name, params, headers, cacheControl) => {
+      global.fetch = jest.fn(
+        async () => new Response('jpeg bytes', { headers }),
+      )
+      const result = await handleRequest(
+        new Request(
+          `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}${params}`,
+        ),
+      )
+      expect(result.status).toEqual(200)
+      expect(result.headers.get('Cache-Control')).toEqual(cacheControl)
+    },
+  )
+
+  test.each([
+    ['https://itunes.apple.com/lookup?id=1', 'disallowed_url'],
+    ['http://is1-ssl.mzstatic.com/a.jpg', 'disallowed_url'],
+    ['https://evil.example/a.jpg', 'disallowed_url'],
+    ['not a url', 'invalid_url'],
+  ])('rejects %s as %s', async (url, code) => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request(`https://podr.test/artwork?url=${encodeURIComponent(url)}`),
+    )
+    expect(result.status).toEqual(400)
+    expect((await result.json()).error.code).toEqual(code)
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('accepts a double-encoded url', async () => {
+    global.fetch = jest.fn(async () => new Response('jpeg bytes'))
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(
+          encodeURIComponent(ARTWORK),
+        )}`,
+      ),
+    )
+    expect(result.status).toEqual(200)
+    expect(global.fetch.mock.calls[0][0]).toEqual(ARTWORK)
+  })
+
+  test.each([
+    ['a missing scheme', 'is1-ssl.mzstatic.com/a.jpg'],
+    ['bad characters', 'ht!tp://bad'],
+    ['a relative URL', '/image/thumb/a.jpg'],
+    ['a protocol-relative URL', '//is1-ssl.mzstatic.com/a.jpg'],
+    ['a non-http scheme', 'javascript:alert(1)'],
+    ['an empty host', 'https://'],
+  ])('rejects %s as malformed', async (_name, url) => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request(`https://podr.test/artwork?url=${encodeURIComponent(url)}`),
+    )
+    expect(result.status).toEqual(400)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'invalid_url',
+        message: 'url must be an absolute http(s) URL',
+      },
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('reports an unreachable upstream as a 502', async () => {
+    global.fetch = jest.fn(async () => {
+      throw new Error('connection refused')
+    })
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}`,
+      ),
+    )
+    expect(result.status).toEqual(502)
+    expect((await result.json()).error.code).toEqual('upstream_error')
+  })
+
+  test('responds 504 when the upstream exceeds the timeout', async () => {
+    global.FETCH_TIMEOUT_MS = '10'
+    global.fetch = jest.fn(
+      (_url: string, init: RequestInit) =>
+        new Promise((_resolve, reject) => {
+          init.signal?.addEventListener('abort', () =>
+            reject(new Error('aborted')),
+          )
+        }),
+    )
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}`,
+      ),
+    )
+    expect(result.status).toEqual(504)
+    expect((await result.json()).error.code).toEqual('upstream_timeout')
+  })
+
+  test('shares the upstream fetch slots with the JSON proxy', async () => {
+    global.MAX_CONCURRENT_FETCHES = '1'
+    global.FETCH_QUEUE_MODE = 'reject'
+    let release: () => void = () => undefined
+    const gate = new Promise<void>((resolve) => (release = resolve))
+    global.fetch = jest.fn(async () => {
+      await gate
+      return new Response(JSON.stringify({ resultCount: 0, results: [] }))
+    })
+    const lookup = handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}`,
+      ),
+    )
+    expect(result.status).toEqual(503)
+    expect(result.headers.get('Retry-After')).toEqual('1')
+    expect((await result.json()).error.code).toEqual('upstream_busy')
+
+    release()
+    expect((await lookup).status).toEqual(200)
+  })
+
+  test.each(['0', '5000', 'big'])('rejects w=%s', async (w) => {
+    global.ARTWORK_MAX_DIMENSION = '1000'
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request(
+        `https://podr.test/artwork?url=${encodeURIComponent(ARTWORK)}&w=${w}`,
+      ),
+    )
+    expect(result.status).toEqual(400)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'invalid_dimensions',
+        message: 'w and h must be integers between 1 and 1000',
+      },
+    })
+  })
+})
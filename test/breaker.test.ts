@@ -0,0 +1,88 @@
+import { CircuitBreaker, CircuitOpenError } from '../src/breaker'
+
+declare var global: any
+
+describe('breaker', () => {
+  let now: jest.SpyInstance
+
+  beforeEach(() => {
+    global.BREAKER_MIN_REQUESTS = '4'
+    global.BREAKER_FAILURE_RATIO = '0.5'
+    global.BREAKER_COOLDOWN_SECONDS = '10'
+    now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+  })
+
+  afterEach(() => {
+    delete global.BREAKER_MIN_REQUESTS
+    delete global.BREAKER_FAILURE_RATIO
+    delete global.BREAKER_COOLDOWN_SECONDS
+    jest.restoreAllMocks()
+  })
+
+  const isFailure = (status: number) => status >= 500
+  const respond = (breaker: CircuitBreaker, status: number) =>
+    breaker.run(async () => status, isFailure)
+
+  test('opens once the failure ratio is reached', async () => {
+    const breaker = new CircuitBreaker()
+    await respond(breaker, 200)
+    await respond(breaker, 200)
+    await respond(breaker, 503)
+    await respond(breaker, 503)
+
+    const call = jest.fn(async () => 200)
+    await expect(breaker.run(call, isFailure)).rejects.toEqual(
+      new CircuitOpenError(10),
+    )
+    expect(call).not.toHaveBeenCalled()
+  })
+
+  test('stays closed below the minimum request count', async () => {
+    const breaker = new CircuitBreaker()
+    await respond(breaker, 503)
+    await respond(breaker, 503)
+    await respond(breaker, 503)
+
+    await expect(respond(breaker, 200)).resolves.toEqual(200)
+  })
+
+  test('counts thrown errors as failures', async () => {
+    const breaker = new CircuitBreaker()
+    for (let i = 0; i < 4; i++) {
+      await expect(
+        breaker.run(async () => {
+          throw new Error('connection reset')
+        }, isFailure),
+      ).rejects.toThrow('connection reset')
+    }
+
+    await expect(respond(breaker, 200)).rejects.toBeInstanceOf(
+      CircuitOpenError,
+    )
+  })
+
+  test('recovers after a successful trial request', async () => {
+    const breaker = new CircuitBreaker()
+    for (let i = 0; i < 4; i++) {
+      await respond(breaker, 503)
+    }
+
+    now.mockReturnValue(10 * 1000)
+    await expect(respond(breaker, 200)).resolves.toEqual(200)
+    await expect(respond(breaker, 200)).resolves.toEqual(200)
+  })
+
+  test('reopens after a failed trial request', async () => {
+    const breaker = new CircuitBreaker()
+    for (let i = 0; i < 4; i++) {
+      await respond(breaker, 503)
+    }
+
+    now.mockReturnValue(10 * 1000)
+    await respond(breaker, 503)
+    await expect(respond(breaker, 200)).rejects.toEqual(
+      new CircuitOpenError(10),
+    )
+  })
+})
@@ -1,18 +1,1537 @@
+import { circuitBreaker } from '../src/breaker'
+import { responseCache } from '../src/cache'
 import { handleRequest } from '../src/handler'
 import makeServiceWorkerEnv from 'service-worker-mock'
 
 declare var global: any
 
+function mockFetch(body: unknown, init: ResponseInit = {}) {
+  global.fetch = jest.fn(async () => new Response(JSON.stringify(body), init))
+  return global.fetch
+}
+
 describe('handle', () => {
   beforeEach(() => {
     Object.assign(global, makeServiceWorkerEnv())
     jest.resetModules()
+    responseCache.clear()
+    circuitBreaker.reset()
+  })
+
+  afterEach(() => {
+    delete global.FETCH_TIMEOUT_MS
+    delete global.CACHE_TTL_SECONDS
+    delete global.NEGATIVE_CACHE_TTL_SECONDS
+    delete global.STALE_WHILE_REVALIDATE_SECONDS
+    delete global.READY_PROBE
+    delete global.MAX_RESPONSE_BYTES
+    delete global.MAX_RETRIES
+    delete global.BREAKER_MIN_REQUESTS
+    delete global.MAX_REDIRECTS
+    delete global.BATCH_MAX_ITEMS
+    delete global.MAX_CONCURRENT_FETCHES
+    delete global.FETCH_QUEUE_MODE
+    delete global.UPSTREAM_USER_AGENT
+    delete global.FORWARD_ACCEPT_LANGUAGE
+    delete global.FORWARD_COOKIES
+    delete global.DEFAULT_STOREFRONT
+    delete global.SEARCH_MAX_PAGES
+    delete global.UPSTREAM_PRIMARY
+    delete global.UPSTREAM_SECONDARY
+    delete global.EMIT_CACHE_CONTROL
+    delete global.DEFAULT_MAX_AGE
+    delete global.STRIP_FIELDS
+    delete global.ADMIN_TOKEN
+    delete global.WARMUP_MAX_ITEMS
+    delete global.__GIT_COMMIT__
+    delete global.__BUILD_TIME__
+    delete global.__NODE_VERSION__
+    jest.restoreAllMocks()
   })
 
   test('handle GET', async () => {
-    const result = await handleRequest(new Request('/', { method: 'GET' }))
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history&limit=5', { method: 'GET' }),
+    )
+    expect(result.status).toEqual(200)
+    expect(await result.json()).toEqual({ resultCount: 0, results: [] })
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/search?media=podcast&term=history&limit=5',
+    )
+  })
+
+  test('forwards upstream caching headers', async () => {
+    mockFetch(
+      { resultCount: 0, results: [] },
+      {
+        headers: {
+          'Cache-Control': 'max-age=300',
+          ETag: '"abc123"',
+          Connection: 'keep-alive',
+        },
+      },
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.headers.get('Cache-Control')).toEqual('max-age=300')
+    expect(result.headers.get('ETag')).toEqual('"abc123"')
+    expect(result.headers.get('Connection')).toBeNull()
+  })
+
+  test.each([
+    [undefined, undefined, undefined, null],
+    [undefined, undefined, 'max-age=60', 'max-age=60'],
+    ['true', undefined, undefined, 'public, max-age=300'],
+    ['true', '3600', undefined, 'public, max-age=3600'],
+    ['true', '3600', 'max-age=60', 'public, max-age=3600'],
+    ['true', undefined, 'no-store', 'no-store'],
+    ['true', undefined, 'private, max-age=60', 'private, max-age=60'],
+  ])(
+    'with EMIT_CACHE_CONTROL=%p and DEFAULT_MAX_AGE=%p, upstream %p becomes %p',
+    async (emit, maxAge, upstream, expected) => {
+      global.EMIT_CACHE_CONTROL = emit
+      global.DEFAULT_MAX_AGE = maxAge
+      mockFetch(
+        { resultCount: 0, results: [] },
+        { headers: upstream ? { 'Cache-Control': upstream } : {} },
+      )
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.headers.get('Cache-Control')).toEqual(expected)
+    },
+  )
+
+  test('does not emit Cache-Control on errors', async () => {
+    global.EMIT_CACHE_CONTROL = 'true'
+    mockFetch({}, { status: 500 })
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.headers.get('Cache-Control')).toBeNull()
+  })
+
+  test('strips STRIP_FIELDS from each result', async () => {
+    global.STRIP_FIELDS = 'collectionViewUrl, trackViewUrl,wrapperType'
+    mockFetch({
+      resultCount: 2,
+      results: [
+        {
+          wrapperType: 'track',
+          kind: 'podcast',
+          collectionId: 1200361736,
+          trackId: 1200361736,
+          collectionName: 'The Daily',
+          collectionViewUrl:
+            'https://podcasts.apple.com/us/podcast/the-daily/id1200361736?uo=4',
+          trackViewUrl:
+            'https://podcasts.apple.com/us/podcast/the-daily/id1200361736?uo=4',
+          genres: ['Daily News', 'Podcasts'],
+        },
+        {
+          wrapperType: 'track',
+          kind: 'podcast',
+          trackId: 1,
+          collectionName: 'Up First',
+        },
+      ],
+    })
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1200361736,1'),
+    )
+    expect(await result.json()).toEqual({
+      resultCount: 2,
+      results: [
+        {
+          kind: 'podcast',
+          collectionId: 1200361736,
+          trackId: 1200361736,
+          collectionName: 'The Daily',
+          genres: ['Daily News', 'Podcasts'],
+        },
+        { kind: 'podcast', trackId: 1, collectionName: 'Up First' },
+      ],
+    })
+  })
+
+  test('leaves non-JSON responses alone when stripping fields', async () => {
+    global.STRIP_FIELDS = 'errorMessage'
+    global.fetch = jest.fn(
+      async () =>
+        new Response('{"errorMessage":"Not found"}', {
+          status: 404,
+          headers: { 'Content-Type': 'text/javascript; charset=utf-8' },
+        }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(await result.text()).toEqual('{"errorMessage":"Not found"}')
+  })
+
+  test('strips hop-by-hop and cookie headers', async () => {
+    mockFetch(
+      { resultCount: 0, results: [] },
+      {
+        headers: {
+          'Cache-Control': 'max-age=300',
+          'Last-Modified': 'Mon, 01 Jan 2024 00:00:00 GMT',
+          Vary: 'Accept-Encoding',
+          Connection: 'X-Edge-Hint',
+          'X-Edge-Hint': 'pop=sea',
+          'Keep-Alive': 'timeout=5',
+          'Proxy-Authenticate': 'Basic',
+          'Set-Cookie': 'itspod=1; Domain=apple.com',
+        },
+      },
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.headers.get('Cache-Control')).toEqual('max-age=300')
+    expect(result.headers.get('Last-Modified')).toEqual(
+      'Mon, 01 Jan 2024 00:00:00 GMT',
+    )
+    expect(result.headers.get('Vary')).toEqual('Accept-Encoding')
+    expect(result.headers.get('Connection')).toBeNull()
+    expect(result.headers.get('X-Edge-Hint')).toBeNull()
+    expect(result.headers.get('Keep-Alive')).toBeNull()
+    expect(result.headers.get('Proxy-Authenticate')).toBeNull()
+    expect(result.headers.get('Set-Cookie')).toBeNull()
+  })
+
+  test('forwards cookies with FORWARD_COOKIES=true', async () => {
+    global.FORWARD_COOKIES = 'true'
+    mockFetch(
+      { resultCount: 0, results: [] },
+      { headers: { 'Set-Cookie': 'itspod=1' } },
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.headers.get('Set-Cookie')).toEqual('itspod=1')
+  })
+
+  test('serves repeat requests from the cache', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const first = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    const second = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(first.headers.get('X-Cache')).toEqual('MISS')
+    expect(second.headers.get('X-Cache')).toEqual('HIT')
+    expect(await second.json()).toEqual({ resultCount: 0, results: [] })
+    expect(fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('expires cached responses after the TTL', async () => {
+    global.CACHE_TTL_SECONDS = '60'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    now.mockReturnValue(61 * 1000)
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('serves stale responses while revalidating in the background', async () => {
+    global.CACHE_TTL_SECONDS = '60'
+    global.STALE_WHILE_REVALIDATE_SECONDS = '30'
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    global.fetch = jest
+      .fn()
+      .mockResolvedValueOnce(new Response('{"resultCount":1,"results":[]}'))
+      .mockResolvedValueOnce(new Response('{"resultCount":2,"results":[]}'))
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+
+    now.mockReturnValue(70 * 1000)
+    const pending: Promise<unknown>[] = []
+    const context = {
+      waitUntil: (promise: Promise<unknown>) => pending.push(promise),
+    }
+    const stale = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+      context,
+    )
+    const again = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+      context,
+    )
+    expect(stale.headers.get('X-Cache')).toEqual('STALE')
+    expect(await stale.json()).toEqual({ resultCount: 1, results: [] })
+    expect(again.headers.get('X-Cache')).toEqual('STALE')
+
+    await Promise.all(pending)
+    const refreshed = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(refreshed.headers.get('X-Cache')).toEqual('HIT')
+    expect(await refreshed.json()).toEqual({ resultCount: 2, results: [] })
+    expect(global.fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('does not serve stale responses past the window', async () => {
+    global.CACHE_TTL_SECONDS = '60'
+    global.STALE_WHILE_REVALIDATE_SECONDS = '30'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    now.mockReturnValue(91 * 1000)
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('caches 404 responses as negative results', async () => {
+    const fetch = mockFetch(
+      { errorMessage: 'Not found' },
+      { status: 404, headers: { 'Content-Type': 'text/javascript' } },
+    )
+    const first = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    const second = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(first.headers.get('X-Cache')).toEqual('MISS')
+    expect(second.status).toEqual(404)
+    expect(second.headers.get('X-Cache')).toEqual('HIT-NEGATIVE')
+    expect(await second.json()).toEqual({ errorMessage: 'Not found' })
+    expect(fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('expires negative results after NEGATIVE_CACHE_TTL_SECONDS', async () => {
+    global.NEGATIVE_CACHE_TTL_SECONDS = '10'
+    const fetch = mockFetch({ errorMessage: 'Not found' }, { status: 404 })
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    now.mockReturnValue(9 * 1000)
+    const cached = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    now.mockReturnValue(11 * 1000)
+    const expired = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(cached.headers.get('X-Cache')).toEqual('HIT-NEGATIVE')
+    expect(expired.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('does not cache 5xx responses', async () => {
+    const fetch = mockFetch({ errorMessage: 'Oops' }, { status: 500 })
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(500)
+    expect(result.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('does not cache no-store responses', async () => {
+    const fetch = mockFetch(
+      { resultCount: 0, results: [] },
+      { headers: { 'Cache-Control': 'no-store' } },
+    )
+    await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('shares one upstream fetch between concurrent requests', async () => {
+    let release: () => void = () => undefined
+    const gate = new Promise<void>((resolve) => (release = resolve))
+    global.fetch = jest.fn(async () => {
+      await gate
+      return new Response(JSON.stringify({ resultCount: 0, results: [] }))
+    })
+    const pending = Array.from({ length: 50 }, () =>
+      handleRequest(
+        new Request('https://podr.test/?q=history', { method: 'GET' }),
+      ),
+    )
+    release()
+    const results = await Promise.all(pending)
+    expect(global.fetch).toHaveBeenCalledTimes(1)
+    for (const result of results) {
+      expect(result.status).toEqual(200)
+      expect(await result.json()).toEqual({ resultCount: 0, results: [] })
+    }
+  })
+
+  test('propagates a shared upstream failure to every caller', async () => {
+    global.MAX_RETRIES = '0'
+    global.fetch = jest.fn(async () => {
+      throw new Error('connection reset')
+    })
+    const results = await Promise.all(
+      Array.from({ length: 5 }, () =>
+        handleRequest(
+          new Request('https://podr.test/?q=history', { method: 'GET' }),
+        ),
+      ),
+    )
+    expect(results.map((result) => result.status)).toEqual([
+      502, 502, 502, 502, 502,
+    ])
+    expect(global.fetch).toHaveBeenCalledTimes(1)
+
+    await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(global.fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('responds 504 when the upstream exceeds the timeout', async () => {
+    global.FETCH_TIMEOUT_MS = '10'
+    global.fetch = jest.fn(
+      (_url: string, init: RequestInit) =>
+        new Promise((_resolve, reject) => {
+          init.signal?.addEventListener('abort', () =>
+            reject(new Error('aborted')),
+          )
+        }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.status).toEqual(504)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'upstream_timeout',
+        message: 'Upstream request timed out',
+      },
+    })
+  })
+
+  test('responds 400 when the query is missing', async () => {
+    const result = await handleRequest(
+      new Request('https://podr.test/', { method: 'GET' }),
+    )
+    expect(result.status).toEqual(400)
+    expect(await result.json()).toEqual({
+      error: { code: 'missing_query', message: 'Missing q parameter' },
+    })
+  })
+
+  test.each([
+    ['GET', '/favicon.ico'],
+    ['GET', '/foo?q=history'],
+    ['GET', '/search/'],
+    ['POST', '/foo'],
+  ])('responds 404 to %s %s', async (method, path) => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request(`https://podr.test${path}`, { method }),
+    )
+    expect(result.status).toEqual(404)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'not_found',
+        message: `No endpoint at ${new URL(path, 'https://podr.test').pathname}`,
+      },
+      endpoints: [
+        '/',
+        '/search',
+        '/lookup',
+        '/batch',
+        '/artwork',
+        '/healthz',
+        '/readyz',
+        '/version',
+      ],
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('still searches with q on /', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history'),
+    )
+    expect(result.status).toEqual(200)
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/search?media=podcast&term=history',
+    )
+  })
+
+  test('responds 502 when the upstream request fails', async () => {
+    global.MAX_RETRIES = '0'
+    global.fetch = jest.fn(async () => {
+      throw new Error('connection reset')
+    })
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.status).toEqual(502)
+    expect(await result.json()).toEqual({
+      error: { code: 'upstream_error', message: 'Upstream request failed' },
+    })
+  })
+
+  test('responds 502 when the upstream body exceeds the size limit', async () => {
+    global.MAX_RESPONSE_BYTES = '16'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    mockFetch({ results: ['a result that is longer than sixteen bytes'] })
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'GET' }),
+    )
+    expect(result.status).toEqual(502)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'upstream_too_large',
+        message: 'Upstream response exceeds 16 bytes',
+      },
+    })
+  })
+
+  test('rejects methods other than GET and HEAD with a 405', async () => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request('https://podr.test/?q=history', { method: 'POST' }),
+    )
+    expect(result.status).toEqual(405)
+    expect(result.headers.get('Allow')).toEqual('GET, HEAD')
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'method_not_allowed',
+        message: 'Method POST not allowed',
+      },
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('forwards HEAD requests upstream', async () => {
+    global.fetch = jest.fn(
+      async () =>
+        new Response(null, {
+          headers: { 'Content-Length': '1234', ETag: '"abc123"' },
+        }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', { method: 'HEAD' }),
+    )
+    expect(result.status).toEqual(200)
+    expect(result.headers.get('ETag')).toEqual('"abc123"')
+    expect(result.headers.get('Content-Length')).toEqual('1234')
+    expect(await result.text()).toEqual('')
+    expect(global.fetch.mock.calls[0][1].method).toEqual('HEAD')
+  })
+
+  test('answers HEAD from a cached GET', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', { method: 'HEAD' }),
+    )
+    expect(result.status).toEqual(200)
+    expect(result.headers.get('X-Cache')).toEqual('HIT')
+    expect(await result.text()).toEqual('')
+    expect(fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('reports liveness on /healthz', async () => {
+    const result = await handleRequest(new Request('https://podr.test/healthz'))
+    expect(result.status).toEqual(200)
+    expect(await result.text()).toEqual('ok')
+  })
+
+  test('reports unknown build metadata by default on /version', async () => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(new Request('https://podr.test/version'))
+    expect(result.status).toEqual(200)
+    expect(await result.json()).toEqual({
+      commit: 'unknown',
+      buildTime: 'unknown',
+      nodeVersion: 'unknown',
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('reports build metadata on /version', async () => {
+    global.__GIT_COMMIT__ = '4edcfb3'
+    global.__BUILD_TIME__ = '2024-01-01T00:00:00.000Z'
+    global.__NODE_VERSION__ = ''
+    const result = await handleRequest(new Request('https://podr.test/version'))
+    expect(await result.json()).toEqual({
+      commit: '4edcfb3',
+      buildTime: '2024-01-01T00:00:00.000Z',
+      nodeVersion: 'unknown',
+    })
+  })
+
+  test('reports readiness on /readyz', async () => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(new Request('https://podr.test/readyz'))
+    expect(result.status).toEqual(200)
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('fails readiness when the iTunes probe fails', async () => {
+    global.READY_PROBE = 'true'
+    mockFetch({}, { status: 503 })
+    const result = await handleRequest(new Request('https://podr.test/readyz'))
+    expect(result.status).toEqual(503)
+  })
+
+  test('builds the upstream URL for /search', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const result = await handleRequest(
+      new Request(
+        'https://podr.test/search?term=true%20crime&entity=podcastEpisode&limit=20&country=gb',
+      ),
+    )
+    expect(result.status).toEqual(200)
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/search?media=podcast&term=true+crime&entity=podcastEpisode&limit=20&country=gb',
+    )
+  })
+
+  test('defaults /search to podcasts', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(new Request('https://podr.test/search?term=history'))
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/search?media=podcast&term=history',
+    )
+  })
+
+  test('requires a term for /search', async () => {
+    const result = await handleRequest(new Request('https://podr.test/search'))
+    expect(result.status).toEqual(400)
+    expect(await result.json()).toEqual({
+      error: { code: 'missing_query', message: 'Missing term parameter' },
+    })
+  })
+
+  test.each([
+    ['50', '50', null],
+    ['200', '200', null],
+    ['5000', '200', 'true'],
+    ['0', '1', 'true'],
+    ['-5', '1', 'true'],
+  ])(
+    'sends limit=%s for /search as %s',
+    async (limit, sent, clampedHeader) => {
+      const fetch = mockFetch({ resultCount: 0, results: [] })
+      const result = await handleRequest(
+        new Request(`https://podr.test/search?term=history&limit=${limit}`),
+      )
+      expect(result.status).toEqual(200)
+      expect(result.headers.get('X-Limit-Clamped')).toEqual(clampedHeader)
+      expect(new URL(fetch.mock.calls[0][0]).searchParams.get('limit')).toEqual(
+        sent,
+      )
+    },
+  )
+
+  test.each(['ten', '1.5', '', '0x10'])(
+    'rejects limit=%p for /search',
+    async (limit) => {
+      global.fetch = jest.fn()
+      const result = await handleRequest(
+        new Request(`https://podr.test/search?term=history&limit=${limit}`),
+      )
+      expect(result.status).toEqual(400)
+      expect(await result.json()).toEqual({
+        error: { code: 'invalid_limit', message: 'limit must be an integer' },
+      })
+      expect(global.fetch).not.toHaveBeenCalled()
+    },
+  )
+
+  describe('all=true', () => {
+    function paginate(total: number) {
+      global.fetch = jest.fn(async (url: string) => {
+        const params = new URL(url).searchParams
+        const offset = Number(params.get('offset') || 0)
+        const limit = Number(params.get('limit'))
+        // Pages overlap by one result, as iTunes' do when the index shifts.
+        const start = Math.max(offset - 1, 0)
+        const results = Array.from(
+          { length: Math.max(Math.min(limit, total - start), 0) },
+          (_, i) => ({ trackId: start + i }),
+        )
+        return new Response(
+          JSON.stringify({ resultCount: results.length, results }),
+        )
+      })
+      return global.fetch
+    }
+
+    test('merges pages and dedupes by trackId', async () => {
+      const fetch = paginate(450)
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true'),
+      )
+      expect(result.status).toEqual(200)
+      const body = await result.json()
+      expect(body.resultCount).toEqual(450)
+      expect(body.results.map((r: any) => r.trackId)).toEqual(
+        Array.from({ length: 450 }, (_, i) => i),
+      )
+      expect(fetch.mock.calls.map((call: any) => call[0])).toEqual([
+        'https://itunes.apple.com/search?media=podcast&term=history&limit=200',
+        'https://itunes.apple.com/search?media=podcast&term=history&limit=200&offset=200',
+        'https://itunes.apple.com/search?media=podcast&term=history&limit=200&offset=400',
+      ])
+    })
+
+    test('stops once max results are collected', async () => {
+      const fetch = paginate(1000)
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true&max=250'),
+      )
+      const body = await result.json()
+      expect(body.resultCount).toEqual(250)
+      expect(fetch).toHaveBeenCalledTimes(2)
+    })
+
+    test('bounds the number of upstream requests', async () => {
+      global.SEARCH_MAX_PAGES = '2'
+      const fetch = paginate(10000)
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true&max=5000'),
+      )
+      const body = await result.json()
+      expect(result.headers.get('X-Limit-Clamped')).toEqual('true')
+      expect(body.resultCount).toEqual(399)
+      expect(fetch).toHaveBeenCalledTimes(2)
+    })
+
+    test('fails when a page fails', async () => {
+      global.fetch = jest
+        .fn()
+        .mockResolvedValueOnce(
+          new Response(
+            JSON.stringify({
+              resultCount: 200,
+              results: Array.from({ length: 200 }, (_, i) => ({ trackId: i })),
+            }),
+          ),
+        )
+        .mockResolvedValueOnce(
+          new Response('{"errorMessage":"Bad offset"}', { status: 400 }),
+        )
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true'),
+      )
+      expect(result.status).toEqual(400)
+      expect(await result.json()).toEqual({ errorMessage: 'Bad offset' })
+    })
+
+    test('fails when the merged results exceed the size limit', async () => {
+      // Each page fits in 3500 bytes, but the 250 merged results do not.
+      global.MAX_RESPONSE_BYTES = '3500'
+      jest.spyOn(console, 'log').mockImplementation(() => undefined)
+      const fetch = paginate(250)
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true'),
+      )
+      expect(fetch).toHaveBeenCalledTimes(2)
+      expect(result.status).toEqual(502)
+      expect(await result.json()).toEqual({
+        error: {
+          code: 'upstream_too_large',
+          message: 'Merged search results exceed 3500 bytes',
+        },
+      })
+    })
+
+    test('forwards Accept-Language for every page', async () => {
+      global.FORWARD_ACCEPT_LANGUAGE = 'true'
+      const fetch = paginate(250)
+      await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true', {
+          headers: {
+            'Accept-Language': 'fr-FR',
+            'If-None-Match': '"abc123"',
+          },
+        }),
+      )
+      expect(fetch).toHaveBeenCalledTimes(2)
+      fetch.mock.calls.forEach((call: any) => {
+        const sent = new Headers(call[1].headers)
+        expect(sent.get('Accept-Language')).toEqual('fr-FR')
+        expect(sent.get('If-None-Match')).toBeNull()
+      })
+    })
+
+    test('answers HEAD without a body', async () => {
+      paginate(10)
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true', {
+          method: 'HEAD',
+        }),
+      )
+      expect(result.status).toEqual(200)
+      expect(await result.text()).toEqual('')
+    })
+
+    test('rejects limit alongside all=true', async () => {
+      global.fetch = jest.fn()
+      const result = await handleRequest(
+        new Request('https://podr.test/search?term=history&all=true&limit=50'),
+      )
+      expect(result.status).toEqual(400)
+      expect(await result.json()).toEqual({
+        error: {
+          code: 'invalid_limit',
+          message: 'limit cannot be combined with all=true, use max instead',
+        },
+      })
+      expect(global.fetch).not.toHaveBeenCalled()
+    })
+
+    test.each(['0', 'lots'])('rejects max=%s', async (max) => {
+      global.fetch = jest.fn()
+      const result = await handleRequest(
+        new Request(
+          `https://podr.test/search?term=history&all=true&max=${max}`,
+        ),
+      )
+      expect(result.status).toEqual(400)
+      expect(global.fetch).not.toHaveBeenCalled()
+    })
+  })
+
+  test('clamps the limit of raw URLs in a batch', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: JSON.stringify([
+          'https://itunes.apple.com/search?term=history&limit=5000',
+          'https://itunes.apple.com/search?term=news&limit=lots',
+        ]),
+      }),
+    )
+    expect(result.headers.get('X-Limit-Clamped')).toEqual('true')
+    expect(fetch).toHaveBeenCalledTimes(1)
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/search?term=history&limit=200',
+    )
+    expect((await result.json())[1]).toEqual({
+      item: 'https://itunes.apple.com/search?term=news&limit=lots',
+      error: { code: 'invalid_limit', message: 'limit must be an integer' },
+    })
+  })
+
+  test('only accepts iTunes search and lookup URLs in a batch', async () => {
+    global.UPSTREAM_SECONDARY = 'itunes-backup.example'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const error = {
+      code: 'invalid_url',
+      message: 'item must be an iTunes ID or an iTunes search or lookup URL',
+    }
+    const items = [
+      'https://is1-ssl.mzstatic.com/image/thumb/Podcasts/a.jpg',
+      'https://itunes.apple.com/rss/toppodcasts/json',
+      'https%3A%2F%2Fitunes.apple.com%2Flookup%3Fid%3D1',
+      'https://itunes-backup.example/search?term=news',
+    ]
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: JSON.stringify(items),
+      }),
+    )
+    const body = await result.json()
+    expect(body[0]).toEqual({ item: items[0], error })
+    expect(body[1]).toEqual({ item: items[1], error })
+    expect(body[2].status).toEqual(200)
+    expect(body[3].status).toEqual(200)
+    expect(fetch.mock.calls.map((call: any) => call[0])).toEqual([
+      'https://itunes.apple.com/lookup?id=1',
+      'https://itunes-backup.example/search?term=news',
+    ])
+  })
+
+  test('looks up a collection by id', async () => {
+    const fetch = mockFetch({ resultCount: 1, results: [{ collectionId: 1 }] })
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1200361736&country=us'),
+    )
     expect(result.status).toEqual(200)
-    const text = await result.text()
-    expect(text).toEqual('request method: GET')
+    expect(await result.json()).toEqual({
+      resultCount: 1,
+      results: [{ collectionId: 1 }],
+    })
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=1200361736&country=us',
+    )
+  })
+
+  test('looks up several comma-separated ids', async () => {
+    const fetch = mockFetch({ resultCount: 2, results: [] })
+    await handleRequest(new Request('https://podr.test/lookup?id=1,2'))
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=1%2C2',
+    )
+  })
+
+  test('rejects a non-numeric lookup id', async () => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=abc'),
+    )
+    expect(result.status).toEqual(400)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'invalid_id',
+        message: 'id must be one or more comma-separated numeric IDs',
+      },
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('retries transient upstream failures', async () => {
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    global.fetch = jest
+      .fn()
+      .mockRejectedValueOnce(new Error('connection reset'))
+      .mockResolvedValueOnce(new Response('{}', { status: 503 }))
+      .mockResolvedValueOnce(
+        new Response(JSON.stringify({ resultCount: 0, results: [] })),
+      )
+    const result = await handleRequest(
+      new Request('https://podr.test/search?term=history'),
+    )
+    expect(result.status).toEqual(200)
+    expect(await result.json()).toEqual({ resultCount: 0, results: [] })
+    expect(global.fetch).toHaveBeenCalledTimes(3)
+  })
+
+  test('forwards the last failure once retries run out', async () => {
+    global.MAX_RETRIES = '1'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    const fetch = mockFetch({}, { status: 503 })
+    const result = await handleRequest(
+      new Request('https://podr.test/search?term=history'),
+    )
+    expect(result.status).toEqual(503)
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('does not retry client errors', async () => {
+    const fetch = mockFetch({}, { status: 404 })
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(404)
+    expect(fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('fails fast with a 503 while the circuit is open', async () => {
+    global.MAX_RETRIES = '0'
+    global.BREAKER_MIN_REQUESTS = '2'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    const fetch = mockFetch({}, { status: 500 })
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    await handleRequest(new Request('https://podr.test/lookup?id=2'))
+
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=3'),
+    )
+    expect(result.status).toEqual(503)
+    expect(result.headers.get('Retry-After')).toEqual('30')
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'upstream_unavailable',
+        message: 'iTunes is unavailable, try again later',
+      },
+    })
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test.each([
+    [404, '{"errorMessage":"Not found"}', 'text/javascript; charset=utf-8'],
+    [429, 'Too Many Requests', 'text/html'],
+  ])(
+    'forwards an upstream %i faithfully',
+    async (status, body, contentType) => {
+      global.fetch = jest.fn(
+        async () =>
+          new Response(body, {
+            status,
+            headers: { 'Content-Type': contentType, 'Retry-After': '60' },
+          }),
+      )
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.status).toEqual(status)
+      expect(result.headers.get('X-Upstream-Status')).toEqual(String(status))
+      expect(result.headers.get('Content-Type')).toEqual(contentType)
+      expect(result.headers.get('Retry-After')).toEqual('60')
+      expect(await result.text()).toEqual(body)
+    },
+  )
+
+  test('omits X-Upstream-Status on proxy errors', async () => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=abc'),
+    )
+    expect(result.status).toEqual(400)
+    expect(result.headers.get('X-Upstream-Status')).toBeNull()
+  })
+
+  test('follows redirects to allowed hosts', async () => {
+    global.fetch = jest
+      .fn()
+      .mockResolvedValueOnce(
+        new Response(null, {
+          status: 302,
+          headers: { Location: 'https://itunes.apple.com/lookup?id=2' },
+        }),
+      )
+      .mockResolvedValueOnce(
+        new Response(JSON.stringify({ resultCount: 1, results: [] })),
+      )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(200)
+    expect(global.fetch.mock.calls[0][1].redirect).toEqual('manual')
+    expect(global.fetch.mock.calls[1][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=2',
+    )
+  })
+
+  test('rejects redirects to disallowed hosts', async () => {
+    global.fetch = jest.fn(
+      async () =>
+        new Response(null, {
+          status: 302,
+          headers: { Location: 'http://169.254.169.254/latest/meta-data' },
+        }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(502)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'upstream_redirect',
+        message: 'Upstream redirected to disallowed host 169.254.169.254',
+      },
+    })
+    expect(global.fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('caps the number of redirects', async () => {
+    global.MAX_REDIRECTS = '2'
+    global.fetch = jest.fn(
+      async () =>
+        new Response(null, {
+          status: 301,
+          headers: { Location: '/lookup?id=1' },
+        }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(502)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'upstream_redirect',
+        message: 'Upstream redirected more than 2 times',
+      },
+    })
+    expect(global.fetch).toHaveBeenCalledTimes(3)
+  })
+
+  test('fetches a mixed batch without failing on bad items', async () => {
+    global.MAX_RETRIES = '0'
+    global.fetch = jest.fn(async (url: string) => {
+      if (url.endsWith('id=1')) {
+        return new Response(JSON.stringify({ resultCount: 1, results: [] }))
+      }
+      if (url.endsWith('id=2')) {
+        return new Response('{"errorMessage":"Not found"}', { status: 404 })
+      }
+      throw new Error('connection reset')
+    })
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: JSON.stringify([
+          1,
+          'https://itunes.apple.com/lookup?id=2',
+          'https://evil.example/lookup?id=2',
+          'not a url',
+          '3',
+        ]),
+      }),
+    )
+    expect(result.status).toEqual(200)
+    expect(await result.json()).toEqual([
+      { item: 1, status: 200, body: { resultCount: 1, results: [] } },
+      {
+        item: 'https://itunes.apple.com/lookup?id=2',
+        status: 404,
+        body: { errorMessage: 'Not found' },
+      },
+      {
+        item: 'https://evil.example/lookup?id=2',
+        error: {
+          code: 'invalid_url',
+          message:
+            'item must be an iTunes ID or an iTunes search or lookup URL',
+        },
+      },
+      {
+        item: 'not a url',
+        error: {
+          code: 'invalid_url',
+          message:
+            'item must be an iTunes ID or an iTunes search or lookup URL',
+        },
+      },
+      {
+        item: '3',
+        error: { code: 'upstream_error', message: 'Upstream request failed' },
+      },
+    ])
+    expect(global.fetch).toHaveBeenCalledTimes(3)
+  })
+
+  test('rejects batches over the size limit', async () => {
+    global.BATCH_MAX_ITEMS = '2'
+    global.fetch = jest.fn()
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: JSON.stringify([1, 2, 3]),
+      }),
+    )
+    expect(result.status).toEqual(413)
+    expect(await result.json()).toEqual({
+      error: {
+        code: 'batch_too_large',
+        message: 'Batch may contain at most 2 items',
+      },
+    })
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('rejects a batch body that is not an array', async () => {
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: '{"ids":[1]}',
+      }),
+    )
+    expect(result.status).toEqual(400)
+    expect((await result.json()).error.code).toEqual('invalid_body')
+  })
+
+  test('only accepts POST on /batch', async () => {
+    const result = await handleRequest(new Request('https://podr.test/batch'))
+    expect(result.status).toEqual(405)
+    expect(result.headers.get('Allow')).toEqual('POST')
+  })
+
+  test('rejects fetches beyond the concurrency limit', async () => {
+    global.MAX_CONCURRENT_FETCHES = '1'
+    global.FETCH_QUEUE_MODE = 'reject'
+    let release: () => void = () => undefined
+    const gate = new Promise<void>((resolve) => (release = resolve))
+    global.fetch = jest.fn(async () => {
+      await gate
+      return new Response(JSON.stringify({ resultCount: 0, results: [] }))
+    })
+    const first = handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const second = await handleRequest(
+      new Request('https://podr.test/lookup?id=2'),
+    )
+    expect(second.status).toEqual(503)
+    expect(second.headers.get('Retry-After')).toEqual('1')
+    expect((await second.json()).error.code).toEqual('upstream_busy')
+
+    release()
+    expect((await first).status).toEqual(200)
+    const third = await handleRequest(
+      new Request('https://podr.test/lookup?id=3'),
+    )
+    expect(third.status).toEqual(200)
+  })
+
+  test('identifies itself to iTunes', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'Accept-Language': 'fr-FR' },
+      }),
+    )
+    const sent = new Headers(fetch.mock.calls[0][1].headers)
+    expect(sent.get('User-Agent')).toEqual('podr-service/1.0')
+    expect(sent.get('Accept')).toEqual('application/json')
+    expect(sent.get('Accept-Language')).toBeNull()
+  })
+
+  test('uses UPSTREAM_USER_AGENT and forwards Accept-Language', async () => {
+    global.UPSTREAM_USER_AGENT = 'podr-staging/2.0'
+    global.FORWARD_ACCEPT_LANGUAGE = 'true'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'Accept-Language': 'fr-FR' },
+      }),
+    )
+    const again = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'Accept-Language': 'de-DE' },
+      }),
+    )
+    const sent = new Headers(fetch.mock.calls[0][1].headers)
+    expect(sent.get('User-Agent')).toEqual('podr-staging/2.0')
+    expect(sent.get('Accept-Language')).toEqual('fr-FR')
+    expect(again.headers.get('X-Cache')).toEqual('MISS')
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('forwards conditional headers and relays a 304', async () => {
+    global.fetch = jest.fn(
+      async () =>
+        new Response(null, { status: 304, headers: { ETag: '"abc123"' } }),
+    )
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'If-None-Match': '"abc123"' },
+      }),
+    )
+    expect(result.status).toEqual(304)
+    expect(result.headers.get('ETag')).toEqual('"abc123"')
+    expect(await result.text()).toEqual('')
+    const sent = new Headers(global.fetch.mock.calls[0][1].headers)
+    expect(sent.get('If-None-Match')).toEqual('"abc123"')
+  })
+
+  test('answers a matching If-None-Match from the cache', async () => {
+    const fetch = mockFetch(
+      { resultCount: 0, results: [] },
+      { headers: { ETag: '"abc123"' } },
+    )
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const revalidated = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'If-None-Match': 'W/"abc123"' },
+      }),
+    )
+    const stale = await handleRequest(
+      new Request('https://podr.test/lookup?id=1', {
+        headers: { 'If-None-Match': '"old"' },
+      }),
+    )
+    expect(revalidated.status).toEqual(304)
+    expect(await revalidated.text()).toEqual('')
+    expect(stale.status).toEqual(200)
+    expect(await stale.json()).toEqual({ resultCount: 0, results: [] })
+    expect(fetch).toHaveBeenCalledTimes(1)
+  })
+
+  test('revalidates stale batch items in the background', async () => {
+    global.CACHE_TTL_SECONDS = '60'
+    global.STALE_WHILE_REVALIDATE_SECONDS = '30'
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    const fetch = mockFetch({ resultCount: 1, results: [] })
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+
+    now.mockReturnValue(70 * 1000)
+    const pending: Promise<unknown>[] = []
+    await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        body: JSON.stringify([1]),
+      }),
+      { waitUntil: (promise) => pending.push(promise) },
+    )
+    expect(pending).toHaveLength(1)
+    await Promise.all(pending)
+    expect(fetch).toHaveBeenCalledTimes(2)
+  })
+
+  test('ignores conditional headers on batch items', async () => {
+    const fetch = mockFetch(
+      { resultCount: 0, results: [] },
+      { headers: { ETag: '"abc123"' } },
+    )
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    const result = await handleRequest(
+      new Request('https://podr.test/batch', {
+        method: 'POST',
+        headers: { 'If-None-Match': '"abc123"' },
+        body: JSON.stringify([1, 2]),
+      }),
+    )
+    expect(await result.json()).toEqual([
+      { item: 1, status: 200, body: { resultCount: 0, results: [] } },
+      { item: 2, status: 200, body: { resultCount: 0, results: [] } },
+    ])
+    expect(fetch).toHaveBeenCalledTimes(2)
+    const sent = new Headers(fetch.mock.calls[1][1].headers)
+    expect(sent.get('If-None-Match')).toBeNull()
+  })
+
+  test.each([
+    ['https://podr.test/search?term=npr&country=zz'],
+    ['https://podr.test/lookup?id=1&country=usa'],
+  ])('rejects an unknown country in %s', async (url) => {
+    global.fetch = jest.fn()
+    const result = await handleRequest(new Request(url))
+    expect(result.status).toEqual(400)
+    expect((await result.json()).error.code).toEqual('invalid_country')
+    expect(global.fetch).not.toHaveBeenCalled()
+  })
+
+  test('lowercases the country code', async () => {
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(new Request('https://podr.test/lookup?id=1&country=GB'))
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=1&country=gb',
+    )
+  })
+
+  test('defaults the country from DEFAULT_STOREFRONT', async () => {
+    global.DEFAULT_STOREFRONT = 'CA'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    await handleRequest(new Request('https://podr.test/lookup?id=1'))
+    await handleRequest(new Request('https://podr.test/lookup?id=2&country=fr'))
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=1&country=ca',
+    )
+    expect(fetch.mock.calls[1][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=2&country=fr',
+    )
+  })
+
+  test('ignores an unknown DEFAULT_STOREFRONT', async () => {
+    global.DEFAULT_STOREFRONT = 'zz'
+    const fetch = mockFetch({ resultCount: 0, results: [] })
+    const result = await handleRequest(
+      new Request('https://podr.test/lookup?id=1'),
+    )
+    expect(result.status).toEqual(200)
+    expect(fetch.mock.calls[0][0]).toEqual(
+      'https://itunes.apple.com/lookup?id=1',
+    )
+  })
+
+  describe('failover', () => {
+    beforeEach(() => {
+      global.MAX_RETRIES = '0'
+      global.UPSTREAM_SECONDARY = 'itunes-mirror.example.com'
+      jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    })
+
+    test.each([
+      ['a 5xx', async () => new Response('{}', { status: 503 })],
+      [
+        'a connection error',
+        async () => {
+          throw new Error('connection refused')
+        },
+      ],
+    ])('fails over to the secondary after %s', async (_name, primary) => {
+      global.fetch = jest.fn(async (url: string) =>
+        url.startsWith('https://itunes.apple.com/')
+          ? primary()
+          : new Response('{"resultCount":1,"results":[]}'),
+      )
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.status).toEqual(200)
+      expect(result.headers.get('X-Upstream-Used')).toEqual(
+        'itunes-mirror.example.com',
+      )
+      expect(await result.json()).toEqual({ resultCount: 1, results: [] })
+      expect(global.fetch.mock.calls[1][0]).toEqual(
+        'https://itunes-mirror.example.com/lookup?id=1',
+      )
+    })
+
+    test('reports the primary when it serves the response', async () => {
+      const fetch = mockFetch({ resultCount: 0, results: [] }, { status: 404 })
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.status).toEqual(404)
+      expect(result.headers.get('X-Upstream-Used')).toEqual('itunes.apple.com')
+      expect(fetch).toHaveBeenCalledTimes(1)
+    })
+
+    test('builds URLs against UPSTREAM_PRIMARY', async () => {
+      global.UPSTREAM_PRIMARY = 'itunes-eu.example.com'
+      const fetch = mockFetch({ resultCount: 0, results: [] })
+      await handleRequest(new Request('https://podr.test/lookup?id=1'))
+      expect(fetch.mock.calls[0][0]).toEqual(
+        'https://itunes-eu.example.com/lookup?id=1',
+      )
+    })
+
+    test('returns the secondary response when both fail with a 5xx', async () => {
+      const fetch = mockFetch({}, { status: 503 })
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.status).toEqual(503)
+      expect(result.headers.get('X-Upstream-Used')).toEqual(
+        'itunes-mirror.example.com',
+      )
+      expect(fetch).toHaveBeenCalledTimes(2)
+    })
+
+    test('responds 502 when both are unreachable', async () => {
+      global.fetch = jest.fn(async () => {
+        throw new Error('connection refused')
+      })
+      const result = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(result.status).toEqual(502)
+      expect((await result.json()).error.code).toEqual('upstream_error')
+      expect(global.fetch).toHaveBeenCalledTimes(2)
+    })
+  })
+
+  describe('warmup', () => {
+    function warmup(items: unknown, headers: Record<string, string> = {}) {
+      return handleRequest(
+        new Request('https://podr.test/warmup', {
+          method: 'POST',
+          headers: { Authorization: 'Bearer s3cret', ...headers },
+          body: JSON.stringify(items),
+        }),
+      )
+    }
+
+    beforeEach(() => {
+      global.ADMIN_TOKEN = 's3cret'
+      global.MAX_RETRIES = '0'
+      jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    })
+
+    test('populates the cache and reports partial failures', async () => {
+      global.fetch = jest.fn(async (url: string) => {
+        if (url.endsWith('id=3')) {
+          return new Response('{"errorMessage":"Oops"}', { status: 500 })
+        }
+        if (url.endsWith('id=4')) {
+          throw new Error('connection reset')
+        }
+        return new Response('{"resultCount":1,"results":[]}')
+      })
+      const result = await warmup([
+        1,
+        'https://itunes.apple.com/lookup?id=2',
+        3,
+        '4',
+        'https://evil.example/lookup?id=5',
+      ])
+      expect(result.status).toEqual(200)
+      expect(await result.json()).toEqual({ total: 5, succeeded: 2, failed: 3 })
+      expect(global.fetch).toHaveBeenCalledTimes(4)
+
+      const first = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      const second = await handleRequest(
+        new Request('https://podr.test/lookup?id=2'),
+      )
+      const failed = await handleRequest(
+        new Request('https://podr.test/lookup?id=3'),
+      )
+      expect(first.headers.get('X-Cache')).toEqual('HIT')
+      expect(second.headers.get('X-Cache')).toEqual('HIT')
+      expect(failed.headers.get('X-Cache')).toEqual('MISS')
+    })
+
+    test('waits for stale entries to be refreshed', async () => {
+      global.CACHE_TTL_SECONDS = '60'
+      global.STALE_WHILE_REVALIDATE_SECONDS = '30'
+      const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+      mockFetch({ resultCount: 1, results: [] })
+      await handleRequest(new Request('https://podr.test/lookup?id=1'))
+      await handleRequest(new Request('https://podr.test/lookup?id=2'))
+
+      now.mockReturnValue(70 * 1000)
+      global.fetch = jest.fn(async (url: string) =>
+        url.endsWith('id=1')
+          ? new Response('{"resultCount":2,"results":[]}')
+          : new Response('{"errorMessage":"Oops"}', { status: 500 }),
+      )
+      const result = await warmup([1, 2])
+      expect(await result.json()).toEqual({ total: 2, succeeded: 1, failed: 1 })
+
+      const fresh = await handleRequest(
+        new Request('https://podr.test/lookup?id=1'),
+      )
+      expect(fresh.headers.get('X-Cache')).toEqual('HIT')
+      expect(await fresh.json()).toEqual({ resultCount: 2, results: [] })
+    })
+
+    test('keeps fresh entries without refetching them', async () => {
+      const fetch = mockFetch({ resultCount: 1, results: [] })
+      await handleRequest(new Request('https://podr.test/lookup?id=1'))
+      const result = await warmup([1])
+      expect(await result.json()).toEqual({ total: 1, succeeded: 1, failed: 0 })
+      expect(fetch).toHaveBeenCalledTimes(1)
+    })
+
+    test('does not return the bodies', async () => {
+      mockFetch({ resultCount: 1, results: [{ collectionId: 1 }] })
+      const result = await warmup([1])
+      expect(await result.json()).toEqual({ total: 1, succeeded: 1, failed: 0 })
+    })
+
+    test.each([
+      [undefined, { Authorization: 'Bearer s3cret' }, 404],
+      ['s3cret', { Authorization: 'Bearer wrong' }, 401],
+      ['s3cret', { Authorization: '' }, 401],
+    ])(
+      'guards the endpoint (ADMIN_TOKEN=%p, %p)',
+      async (token, headers, status) => {
+        global.ADMIN_TOKEN = token
+        global.fetch = jest.fn()
+        const result = await warmup([1], headers)
+        expect(result.status).toEqual(status)
+        expect(global.fetch).not.toHaveBeenCalled()
+      },
+    )
+
+    test('rejects oversized warmups', async () => {
+      global.WARMUP_MAX_ITEMS = '2'
+      global.fetch = jest.fn()
+      const result = await warmup([1, 2, 3])
+      expect(result.status).toEqual(413)
+      expect(global.fetch).not.toHaveBeenCalled()
+    })
+
+    test('only accepts POST', async () => {
+      const result = await handleRequest(
+        new Request('https://podr.test/warmup'),
+      )
+      expect(result.status).toEqual(405)
+      expect(result.headers.get('Allow')).toEqual('POST')
+    })
   })
 })
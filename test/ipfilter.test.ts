@@ -0,0 +1,36 @@
+import { ipInList } from '../src/ipfilter'
+
+describe('ipInList', () => {
+  test.each([
+    ['192.0.2.1', '192.0.2.1', true],
+    ['192.0.2.2', '192.0.2.1', false],
+    ['192.0.2.77', '192.0.2.0/24', true],
+    ['192.0.3.1', '192.0.2.0/24', false],
+    ['10.1.2.3', '0.0.0.0/0', true],
+    ['192.0.2.1', '198.51.100.0/24, 192.0.2.1', true],
+    ['2001:db8::1', '2001:db8::/32', true],
+    ['2001:db9::1', '2001:db8::/32', false],
+    ['2001:0db8:0000:0000:0000:0000:0000:0001', '2001:db8::1', true],
+    ['febf::1', 'fe80::/10', true],
+    ['fec0::1', 'fe80::/10', false],
+    ['::ffff:192.0.2.5', '192.0.2.0/24', true],
+    ['192.0.2.5', '::ffff:192.0.2.0/120', true],
+    ['2001:db8::1', '0.0.0.0/0', false],
+    ['192.0.2.1', '::/0', false],
+    ['1.2.3.256', '0.0.0.0/0', false],
+    ['1::2::3', '::/0', false],
+    ['unknown', '0.0.0.0/0', false],
+  ])('%s in %p: %p', (ip, list, expected) => {
+    expect(ipInList(ip, list)).toEqual(expected)
+  })
+
+  test('skips malformed entries', () => {
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    expect(ipInList('192.0.2.1', 'bogus, 192.0.2.1/33, 192.0.2.1')).toEqual(
+      true,
+    )
+    expect(ipInList('192.0.2.2', 'bogus, 192.0.2.1/33, 192.0.2.1')).toEqual(
+      false,
+    )
+  })
+})
@@ -0,0 +1,37 @@
+import { clampLimit, validStorefront } from '../src/itunes'
+
+describe('validStorefront', () => {
+  test.each([
+    ['us', true],
+    ['gb', true],
+    ['JP', true],
+    ['De', true],
+    ['xk', true],
+    ['', false],
+    ['u', false],
+    ['usa', false],
+    ['zz', false],
+    ['kp', false],
+    ['u1', false],
+  ])('%p is %p', (code, expected) => {
+    expect(validStorefront(code)).toEqual(expected)
+  })
+})
+
+describe('clampLimit', () => {
+  test.each([
+    ['1', { limit: 1, clamped: false }],
+    ['50', { limit: 50, clamped: false }],
+    ['200', { limit: 200, clamped: false }],
+    ['201', { limit: 200, clamped: true }],
+    ['5000', { limit: 200, clamped: true }],
+    ['0', { limit: 1, clamped: true }],
+    ['-3', { limit: 1, clamped: true }],
+    ['ten', undefined],
+    ['1.5', undefined],
+    ['', undefined],
+    [' 5', undefined],
+  ])('%p is %p', (value, expected) => {
+    expect(clampLimit(value)).toEqual(expected)
+  })
+})
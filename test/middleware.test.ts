@@ -0,0 +1,618 @@
+import {
+  withCors,
+  withIpFilter,
+  withLogging,
+  withRateLimit,
+  withRecovery,
+  withRequestId,
+  withTracing,
+} from '../src/middleware'
+import { handleRequest } from '../src/handler'
+import { rateLimiter } from '../src/ratelimit'
+import { urlStats } from '../src/stats'
+import { setSpanExporter, Span } from '../src/tracing'
+import { handler as worker } from '../src/worker'
+import makeServiceWorkerEnv from 'service-worker-mock'
+
+declare var global: any
+
+describe('middleware', () => {
+  beforeEach(() => {
+    Object.assign(global, makeServiceWorkerEnv())
+    jest.resetModules()
+    rateLimiter.clear()
+  })
+
+  afterEach(() => {
+    delete global.LOG_LEVEL
+    delete global.RATE_LIMIT_RPS
+    delete global.RATE_LIMIT_BURST
+    delete global.ALLOWED_ORIGINS
+    delete global.DEBUG_TOKEN
+    delete global.DENY_IPS
+    delete global.ALLOW_IPS
+    delete global.FORWARD_ACCEPT_LANGUAGE
+    setSpanExporter(undefined)
+    jest.restoreAllMocks()
+  })
+
+  test('logs one structured line per request', async () => {
+    const output = jest
+      .spyOn(console, 'log')
+      .mockImplementation(() => undefined)
+    const handler = withLogging(async (_request, context) => {
+      context.upstreamUrl = 'https://itunes.apple.com/search?term=history'
+      context.upstreamStatus = 200
+      return new Response('{"results":[]}', { status: 200 })
+    })
+
+    const pending: Promise<unknown>[] = []
+    const result = await handler(new Request('https://podr.test/?q=history'), {
+      requestId: 'req-1',
+      waitUntil: (promise) => pending.push(promise),
+    })
+
+    expect(output).not.toHaveBeenCalled()
+    expect(await result.text()).toEqual('{"results":[]}')
+    await Promise.all(pending)
+    expect(output).toHaveBeenCalledTimes(1)
+    const line = JSON.parse(output.mock.calls[0][0])
+    expect(line).toMatchObject({
+      requestId: 'req-1',
+      level: 'INFO',
+      msg: 'request',
+      method: 'GET',
+      path: '/',
+      upstreamUrl: 'https://itunes.apple.com/search?term=history',
+      status: 200,
+      upstreamStatus: 200,
+      bytes: 14,
+    })
+    expect(typeof line.durationMs).toEqual('number')
+  })
+
+  test('passes artwork through without waiting for the whole image', async () => {
+    const output = jest
+      .spyOn(console, 'log')
+      .mockImplementation(() => undefined)
+    const encoder = new TextEncoder()
+    let finish: () => void = () => undefined
+    global.fetch = jest.fn(
+      async () =>
+        new Response(
+          new ReadableStream({
+            start(controller) {
+              controller.enqueue(encoder.encode('first'))
+              finish = () => {
+                controller.enqueue(encoder.encode('last'))
+                controller.close()
+              }
+            },
+          }),
+          { headers: { 'Content-Type': 'image/jpeg' } },
+        ),
+    )
+    const pending: Promise<unknown>[] = []
+    const handler = withLogging(handleRequest)
+    const url = encodeURIComponent(
+      'https://is1-ssl.mzstatic.com/image/thumb/Podcasts/a.jpg',
+    )
+
+    const result = await handler(
+      new Request(`https://podr.test/artwork?url=${url}`),
+      { waitUntil: (promise) => pending.push(promise) },
+    )
+    const reader = result.body!.getReader()
+    const decoder = new TextDecoder()
+    expect(decoder.decode((await reader.read()).value)).toEqual('first')
+    expect(output).not.toHaveBeenCalled()
+
+    finish()
+    expect(decoder.decode((await reader.read()).value)).toEqual('last')
+    expect((await reader.read()).done).toEqual(true)
+    await Promise.all(pending)
+    expect(JSON.parse(output.mock.calls[0][0])).toMatchObject({
+      path: '/artwork',
+      status: 200,
+      bytes: 9,
+    })
+  })
+
+  test('drops lines below LOG_LEVEL', async () => {
+    global.LOG_LEVEL = 'warn'
+    const output = jest
+      .spyOn(console, 'log')
+      .mockImplementation(() => undefined)
+    const handler = withLogging(async () => new Response('ok'))
+
+    await handler(new Request('https://podr.test/healthz'), {})
+
+    expect(output).not.toHaveBeenCalled()
+  })
+
+  test('recovers from a throwing handler with a 500', async () => {
+    const output = jest
+      .spyOn(console, 'log')
+      .mockImplementation(() => undefined)
+    const handler = withRecovery(async () => {
+      throw new Error('boom')
+    })
+
+    const result = await handler(new Request('https://podr.test/?q=x'), {})
+
+    expect(result.status).toEqual(500)
+    expect(await result.json()).toEqual({
+      error: { code: 'internal_error', message: 'Internal server error' },
+    })
+    const line = JSON.parse(output.mock.calls[0][0])
+    expect(line).toMatchObject({ level: 'ERROR', error: 'Error: boom' })
+    expect(line.stack).toContain('boom')
+  })
+
+  test('answers 429 once a client exhausts its bucket', async () => {
+    global.RATE_LIMIT_RPS = '1'
+    global.RATE_LIMIT_BURST = '2'
+    jest.spyOn(Date, 'now').mockReturnValue(0)
+    const handler = withRateLimit(async () => new Response('ok'))
+    const request = () =>
+      new Request('https://podr.test/?q=x', {
+        headers: { 'CF-Connecting-IP': '203.0.113.7' },
+      })
+
+    expect((await handler(request(), {})).status).toEqual(200)
+    expect((await handler(request(), {})).status).toEqual(200)
+    const limited = await handler(request(), {})
+    expect(limited.status).toEqual(429)
+    expect(limited.headers.get('Retry-After')).toEqual('1')
+    expect(await limited.json()).toEqual({
+      error: { code: 'rate_limited', message: 'Too many requests' },
+    })
+
+    const other = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { 'CF-Connecting-IP': '203.0.113.8' },
+      }),
+      {},
+    )
+    expect(other.status).toEqual(200)
+  })
+
+  test('refills the bucket over time', async () => {
+    global.RATE_LIMIT_RPS = '1'
+    global.RATE_LIMIT_BURST = '1'
+    const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+    const handler = withRateLimit(async () => new Response('ok'))
+    const request = () =>
+      new Request('https://podr.test/?q=x', {
+        headers: { 'CF-Connecting-IP': '203.0.113.7' },
+      })
+
+    expect((await handler(request(), {})).status).toEqual(200)
+    expect((await handler(request(), {})).status).toEqual(429)
+    now.mockReturnValue(1000)
+    expect((await handler(request(), {})).status).toEqual(200)
+  })
+
+  test('allows any origin by default', async () => {
+    const handler = withCors(async () => new Response('ok'))
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { Origin: 'https://example.com' },
+      }),
+      {},
+    )
+    expect(result.headers.get('Access-Control-Allow-Origin')).toEqual('*')
+  })
+
+  test('echoes an allowed origin', async () => {
+    global.ALLOWED_ORIGINS = 'https://podr.app, https://beta.podr.app'
+    const handler = withCors(async () => new Response('ok'))
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { Origin: 'https://beta.podr.app' },
+      }),
+      {},
+    )
+    expect(result.headers.get('Access-Control-Allow-Origin')).toEqual(
+      'https://beta.podr.app',
+    )
+    expect(result.headers.get('Vary')).toEqual('Origin')
+  })
+
+  test('omits CORS headers for a disallowed origin', async () => {
+    global.ALLOWED_ORIGINS = 'https://podr.app'
+    const handler = withCors(async () => new Response('ok'))
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { Origin: 'https://evil.example' },
+      }),
+      {},
+    )
+    expect(result.status).toEqual(200)
+    expect(result.headers.get('Access-Control-Allow-Origin')).toBeNull()
+  })
+
+  test('answers preflight requests without calling the handler', async () => {
+    global.ALLOWED_ORIGINS = 'https://podr.app'
+    const inner = jest.fn(async () => new Response('ok'))
+    const handler = withCors(inner)
+    const result = await handler(
+      new Request('https://podr.test/search', {
+        method: 'OPTIONS',
+        headers: {
+          Origin: 'https://podr.app',
+          'Access-Control-Request-Method': 'GET',
+          'Access-Control-Request-Headers': 'x-request-id',
+        },
+      }),
+      {},
+    )
+    expect(result.status).toEqual(204)
+    expect(result.headers.get('Access-Control-Allow-Origin')).toEqual(
+      'https://podr.app',
+    )
+    expect(result.headers.get('Access-Control-Allow-Methods')).toEqual(
+      'GET, HEAD, POST, OPTIONS',
+    )
+    expect(result.headers.get('Access-Control-Allow-Headers')).toEqual(
+      'x-request-id',
+    )
+    expect(inner).not.toHaveBeenCalled()
+  })
+
+  test('preserves an incoming X-Request-ID', async () => {
+    const inner = jest.fn(async () => new Response('ok'))
+    const handler = withRequestId(inner)
+    const context = {}
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { 'X-Request-ID': 'abc-123', 'CF-Ray': '8a1b2c3d4e5f-SEA' },
+      }),
+      context,
+    )
+    expect(result.headers.get('X-Request-ID')).toEqual('abc-123')
+    expect(context).toEqual({ requestId: 'abc-123' })
+  })
+
+  test('falls back to the CF-Ray ID', async () => {
+    const handler = withRequestId(async () => new Response('ok'))
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { 'CF-Ray': '8a1b2c3d4e5f-SEA' },
+      }),
+      {},
+    )
+    expect(result.headers.get('X-Request-ID')).toEqual('8a1b2c3d4e5f-SEA')
+  })
+
+  test('generates an ID when no usable one is sent', async () => {
+    const handler = withRequestId(async () => new Response('ok'))
+    const result = await handler(
+      new Request('https://podr.test/?q=x', {
+        headers: { 'X-Request-ID': 'not a valid id' },
+      }),
+      {},
+    )
+    expect(result.headers.get('X-Request-ID')).toMatch(
+      /^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$/,
+    )
+  })
+
+  test.each([
+    [{ 'CF-Connecting-IP': '203.0.113.7' }, 403],
+    [{ 'CF-Connecting-IP': '198.51.100.1' }, 200],
+    [{ 'CF-Connecting-IP': '2001:db8::42' }, 403],
+    [{ 'X-Forwarded-For': '203.0.113.9, 198.51.100.1' }, 403],
+    [{ 'X-Forwarded-For': '198.51.100.1, 203.0.113.9' }, 200],
+    [
+      {
+        'CF-Connecting-IP': '198.51.100.1',
+        'X-Forwarded-For': '203.0.113.9',
+      },
+      200,
+    ],
+    [
+      {
+        'CF-Connecting-IP': '203.0.113.7',
+        'X-Forwarded-For': '198.51.100.1',
+      },
+      403,
+    ],
+  ])('applies DENY_IPS to %p', async (headers, status) => {
+    global.DENY_IPS = '203.0.113.0/24, 2001:db8::/32'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    const inner = jest.fn(async () => new Response('ok'))
+    const result = await withIpFilter(inner)(
+      new Request('https://podr.test/?q=x', { headers }),
+      {},
+    )
+    expect(result.status).toEqual(status)
+    expect(inner).toHaveBeenCalledTimes(status === 200 ? 1 : 0)
+  })
+
+  test('blocks denied clients before answering preflights', async () => {
+    global.DENY_IPS = '203.0.113.7'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    const preflight = (ip: string) =>
+      new Request('https://podr.test/search', {
+        method: 'OPTIONS',
+        headers: {
+          'CF-Connecting-IP': ip,
+          Origin: 'https://app.example',
+          'Access-Control-Request-Method': 'GET',
+        },
+      })
+
+    const denied = await worker(preflight('203.0.113.7'), {})
+    const allowed = await worker(preflight('198.51.100.1'), {})
+
+    expect(denied.status).toEqual(403)
+    expect(denied.headers.get('Access-Control-Allow-Origin')).toBeNull()
+    expect(allowed.status).toEqual(204)
+    expect(allowed.headers.get('Access-Control-Allow-Origin')).toEqual('*')
+  })
+
+  test('only lets ALLOW_IPS through when it is set', async () => {
+    global.ALLOW_IPS = '198.51.100.1'
+    global.DENY_IPS = '198.51.100.0/24'
+    jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    const handler = withIpFilter(async () => new Response('ok'))
+    const request = (ip?: string) =>
+      new Request('https://podr.test/?q=x', {
+        headers: ip ? { 'CF-Connecting-IP': ip } : {},
+      })
+
+    const denied = await handler(request('198.51.100.1'), {})
+    global.DENY_IPS = ''
+    const allowed = await handler(request('198.51.100.1'), {})
+    const other = await handler(request('192.0.2.1'), {})
+    const unknown = await handler(request(), {})
+
+    expect(denied.status).toEqual(403)
+    expect(await denied.json()).toEqual({
+      error: { code: 'forbidden', message: 'Forbidden' },
+    })
+    expect(allowed.status).toEqual(200)
+    expect(other.status).toEqual(403)
+    expect(unknown.status).toEqual(403)
+  })
+
+  describe('tracing', () => {
+    let exported: Span[]
+
+    beforeEach(() => {
+      exported = []
+      setSpanExporter({
+        export: async (spans) => {
+          exported.push(...spans)
+        },
+      })
+      global.fetch = jest.fn(
+        async () =>
+          new Response('{"resultCount":0,"results":[]}', { status: 200 }),
+      )
+    })
+
+    test('records a server span and a child span for the upstream fetch', async () => {
+      const handler = withTracing(handleRequest)
+      await handler(new Request('https://podr.test/lookup?id=42'), {})
+
+      expect(exported).toHaveLength(2)
+      const [server, client] = exported
+      expect(server).toMatchObject({
+        name: 'GET',
+        kind: 'server',
+        attributes: {
+          'http.request.method': 'GET',
+          'url.path': '/lookup',
+          'http.response.status_code': 200,
+        },
+        error: false,
+      })
+      expect(server.traceId).toMatch(/^[0-9a-f]{32}$/)
+      expect(server.parentSpanId).toBeUndefined()
+      expect(client).toMatchObject({
+        traceId: server.traceId,
+        parentSpanId: server.spanId,
+        kind: 'client',
+        attributes: {
+          'server.address': 'itunes.apple.com',
+          'http.response.status_code': 200,
+          'http.response.body.size': 30,
+        },
+        error: false,
+      })
+      expect(client.endTime).toBeGreaterThanOrEqual(client.startTime)
+    })
+
+    test('records a child span for each batch item', async () => {
+      const handler = withTracing(handleRequest)
+      await handler(
+        new Request('https://podr.test/batch', {
+          method: 'POST',
+          body: JSON.stringify([44]),
+        }),
+        {},
+      )
+
+      expect(exported).toHaveLength(2)
+      const [server, client] = exported
+      expect(server.attributes['url.path']).toEqual('/batch')
+      expect(client).toMatchObject({
+        traceId: server.traceId,
+        parentSpanId: server.spanId,
+        kind: 'client',
+        attributes: {
+          'url.full': 'https://itunes.apple.com/lookup?id=44',
+        },
+      })
+    })
+
+    test('records the upstream URL without the cache key suffix', async () => {
+      global.FORWARD_ACCEPT_LANGUAGE = 'true'
+      const handler = withTracing(handleRequest)
+      await handler(
+        new Request('https://podr.test/lookup?id=43', {
+          headers: { 'Accept-Language': 'fr-FR' },
+        }),
+        {},
+      )
+
+      expect(exported[1].attributes['url.full']).toEqual(
+        'https://itunes.apple.com/lookup?id=43',
+      )
+    })
+
+    test('continues an incoming trace', async () => {
+      const handler = withTracing(async () => new Response('ok'))
+      await handler(
+        new Request('https://podr.test/healthz', {
+          headers: {
+            traceparent:
+              '00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01',
+          },
+        }),
+        {},
+      )
+
+      expect(exported).toHaveLength(1)
+      expect(exported[0].traceId).toEqual('4bf92f3577b34da6a3ce929d0e0e4736')
+      expect(exported[0].parentSpanId).toEqual('00f067aa0ba902b7')
+    })
+
+    test('skips requests whose parent is not sampled', async () => {
+      const handler = withTracing(async () => new Response('ok'))
+      await handler(
+        new Request('https://podr.test/healthz', {
+          headers: {
+            traceparent:
+              '00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00',
+          },
+        }),
+        {},
+      )
+
+      expect(exported).toHaveLength(0)
+    })
+
+    test('starts a new trace for a malformed traceparent', async () => {
+      const handler = withTracing(async () => new Response('ok'))
+      await handler(
+        new Request('https://podr.test/healthz', {
+          headers: {
+            traceparent:
+              '00-00000000000000000000000000000000-00f067aa0ba902b7-01',
+          },
+        }),
+        {},
+      )
+
+      expect(exported).toHaveLength(1)
+      expect(exported[0].parentSpanId).toBeUndefined()
+      expect(exported[0].traceId).not.toEqual(
+        '00000000000000000000000000000000',
+      )
+    })
+
+    test('is a no-op without an exporter', async () => {
+      setSpanExporter(undefined)
+      const context: Record<string, unknown> = {}
+      const handler = withTracing(async () => new Response('ok'))
+      await handler(new Request('https://podr.test/healthz'), context)
+
+      expect(context.spans).toBeUndefined()
+    })
+  })
+
+  describe('stats', () => {
+    beforeEach(() => {
+      urlStats.clear()
+      jest.spyOn(console, 'log').mockImplementation(() => undefined)
+    })
+
+    test('aggregates requests per upstream URL', async () => {
+      global.DEBUG_TOKEN = 's3cret'
+      global.fetch = jest.fn(async (url: string) =>
+        url.endsWith('id=8')
+          ? new Response('{"errorMessage":"Oops"}', { status: 500 })
+          : new Response('{"resultCount":0,"results":[]}', { status: 200 }),
+      )
+      const handler = withLogging(handleRequest)
+      const request = async (url: string) => {
+        const pending: Promise<unknown>[] = []
+        const response = await handler(new Request(url), {
+          waitUntil: (promise) => pending.push(promise),
+        })
+        await response.arrayBuffer()
+        await Promise.all(pending)
+      }
+      await request('https://podr.test/lookup?id=7')
+      await request('https://podr.test/lookup?id=7')
+      await request('https://podr.test/lookup?id=8')
+      await request('https://podr.test/healthz')
+
+      const result = await handler(
+        new Request('https://podr.test/debug/stats?token=s3cret'),
+        {},
+      )
+      expect(result.status).toEqual(200)
+      expect(await result.json()).toEqual({
+        'https://itunes.apple.com/lookup?id=8': {
+          count: 1,
+          avgLatencyMs: expect.any(Number),
+          avgBytes: 23,
+          errors: 1,
+        },
+        'https://itunes.apple.com/lookup?id=7': {
+          count: 2,
+          avgLatencyMs: expect.any(Number),
+          avgBytes: 30,
+          errors: 0,
+        },
+      })
+    })
+
+    test('evicts the least recently requested URLs', () => {
+      global.STATS_MAX_URLS = '2'
+      urlStats.record('https://itunes.apple.com/lookup?id=1', 10, 100, false)
+      urlStats.record('https://itunes.apple.com/lookup?id=2', 10, 100, false)
+      urlStats.record('https://itunes.apple.com/lookup?id=1', 30, 300, false)
+      urlStats.record('https://itunes.apple.com/lookup?id=3', 10, 100, false)
+      delete global.STATS_MAX_URLS
+
+      expect(urlStats.summary()).toEqual({
+        'https://itunes.apple.com/lookup?id=3': {
+          count: 1,
+          avgLatencyMs: 10,
+          avgBytes: 100,
+          errors: 0,
+        },
+        'https://itunes.apple.com/lookup?id=1': {
+          count: 2,
+          avgLatencyMs: 20,
+          avgBytes: 200,
+          errors: 0,
+        },
+      })
+    })
+
+    test.each([
+      [undefined, 'https://podr.test/debug/stats?token=x', {}, 404],
+      ['s3cret', 'https://podr.test/debug/stats', {}, 401],
+      ['s3cret', 'https://podr.test/debug/stats?token=s3cre', {}, 401],
+      [
+        's3cret',
+        'https://podr.test/debug/stats',
+        { Authorization: 'Bearer s3cret' },
+        200,
+      ],
+    ])(
+      'guards the endpoint (DEBUG_TOKEN=%p, %s)',
+      async (token, url, headers, status) => {
+        global.DEBUG_TOKEN = token
+        const result = await handleRequest(new Request(url, { headers }))
+        expect(result.status).toEqual(status)
+      },
+    )
+  })
+})
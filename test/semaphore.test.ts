@@ -0,0 +1,56 @@
+import { ConcurrencyLimitError, Semaphore } from '../src/semaphore'
+
+describe('semaphore', () => {
+  test('fails immediately when full and not queueing', async () => {
+    const semaphore = new Semaphore()
+    await semaphore.acquire(1, 0)
+    await expect(semaphore.acquire(1, 0)).rejects.toBeInstanceOf(
+      ConcurrencyLimitError,
+    )
+  })
+
+  test('hands a released slot to the next waiter', async () => {
+    const semaphore = new Semaphore()
+    const release = await semaphore.acquire(1, 0)
+    const waiting = semaphore.acquire(1, 1000)
+    release()
+    const next = await waiting
+    await expect(semaphore.acquire(1, 0)).rejects.toBeInstanceOf(
+      ConcurrencyLimitError,
+    )
+    next()
+    await expect(semaphore.acquire(1, 0)).resolves.toBeInstanceOf(Function)
+  })
+
+  test('gives up queueing after the timeout', async () => {
+    const semaphore = new Semaphore()
+    const release = await semaphore.acquire(1, 0)
+    await expect(semaphore.acquire(1, 10)).rejects.toThrow(
+      'No slot freed up within 10ms',
+    )
+    release()
+    await expect(semaphore.acquire(1, 0)).resolves.toBeInstanceOf(Function)
+  })
+
+  test('releases the slot when the work throws', async () => {
+    const semaphore = new Semaphore()
+    await expect(
+      semaphore.run(1, 0, async () => {
+        throw new Error('boom')
+      }),
+    ).rejects.toThrow('boom')
+    await expect(semaphore.run(1, 0, async () => 'ok')).resolves.toEqual('ok')
+  })
+
+  test('ignores repeated releases', async () => {
+    const semaphore = new Semaphore()
+    const release = await semaphore.acquire(2, 0)
+    release()
+    release()
+    await semaphore.acquire(2, 0)
+    await semaphore.acquire(2, 0)
+    await expect(semaphore.acquire(2, 0)).rejects.toBeInstanceOf(
+      ConcurrencyLimitError,
+    )
+  })
+})
@@ -0,0 +1,13 @@
+// jest-environment-node doesn't expose Node's Web Crypto and Streams globals,
+// which the Workers runtime provides.
+if (!global.crypto) {
+  global.crypto = require('crypto').webcrypto
+}
+
+const streams = require('stream/web')
+
+for (const name of ['ReadableStream', 'TransformStream', 'WritableStream']) {
+  if (!global[name]) {
+    global[name] = streams[name]
+  }
+}
@@ -1,4 +1,21 @@
+const { execSync } = require('child_process')
 const path = require('path')
+const webpack = require('webpack')
+
+function gitCommit() {
+  if (process.env.GIT_COMMIT) {
+    return process.env.GIT_COMMIT
+  }
+  try {
+    return execSync('git rev-parse HEAD', {
+      stdio: ['ignore', 'pipe', 'ignore'],
+    })
+      .toString()
+      .trim()
+  } catch {
+    return ''
+  }
+}
 
 module.exports = {
   entry: './src/index.ts',
@@ -11,6 +28,13 @@ module.exports = {
   resolve: {
     extensions: ['.ts', '.tsx', '.js'],
   },
+  plugins: [
+    new webpack.DefinePlugin({
+      __GIT_COMMIT__: JSON.stringify(gitCommit()),
+      __BUILD_TIME__: JSON.stringify(new Date().toISOString()),
+      __NODE_VERSION__: JSON.stringify(process.version),
+    }),
+  ],
   module: {
     rules: [
       {